@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+const (
+	alertEventType  = "price_alert"
+	alertKindCross  = "cross"
+	alertKindChange = "change"
+)
+
+// cooldown of rules without their own and webhooks every alert is sent to,
+// overridden by flags in main
+var (
+	alertCooldown = 15 * time.Minute
+	alertWebhooks = []string{}
+)
+
+var maxAlertHistory = 1440
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// one rule of the alerts file, e.g.
+// {"name": "ton below 5", "kind": "cross", "price": "5"}
+// {"name": "ton moves", "kind": "change", "percent": 3, "window": "15m"}
+// token is a jetton master, TON when empty
+type AlertRule struct {
+	Name     string   `json:"name"`
+	Token    string   `json:"token,omitempty"`
+	Kind     string   `json:"kind"`
+	Price    *Decimal `json:"price,omitempty"`
+	Percent  float64  `json:"percent,omitempty"`
+	Window   string   `json:"window,omitempty"`
+	Cooldown string   `json:"cooldown,omitempty"`
+	Webhooks []string `json:"webhooks,omitempty"`
+
+	master   *address.Address
+	window   time.Duration
+	cooldown time.Duration
+
+	// side of the level the price is on for crossings, -1 below, 1 above
+	// and 0 before the first price, atLevel after a crossing that reached
+	// the level exactly. prices within window for changes
+	side      int
+	atLevel   bool
+	observed  []priceObservation
+	lastFired time.Time
+}
+
+type AlertEvent struct {
+	Type   string `json:"type"`
+	Rule   string `json:"rule"`
+	Kind   string `json:"kind"`
+	Master string `json:"master"`
+	Symbol string `json:"symbol"`
+
+	PriceUSD  Decimal `json:"price_usd"`
+	Direction string  `json:"direction"`
+	// level crossed, or price at the start of the window moved from
+	From          Decimal `json:"from"`
+	ChangePercent float64 `json:"change_percent"`
+	Window        string  `json:"window,omitempty"`
+
+	Block uint32    `json:"block"`
+	At    time.Time `json:"at"`
+}
+
+// evaluate alert rules against every new price snapshot
+type AlertEngine struct {
+	mutex   sync.Mutex
+	rules   []*AlertRule
+	version uint64
+	alerts  []AlertEvent
+}
+
+func NewAlertEngine(rules []*AlertRule) *AlertEngine {
+	return &AlertEngine{
+		mutex:  sync.Mutex{},
+		rules:  rules,
+		alerts: make([]AlertEvent, 0),
+	}
+}
+
+// json file with a list of alert rules
+func LoadAlertRules(path string) ([]*AlertRule, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*AlertRule
+	if err := json.Unmarshal(body, &rules); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if err := rule.init(); err != nil {
+			return nil, fmt.Errorf("alert rule %s: %w", rule.Name, err)
+		}
+	}
+
+	log.Info().Msgf("loaded %d alert rules from %s", len(rules), path)
+	return rules, nil
+}
+
+func (r *AlertRule) init() error {
+	r.master = tonMasterAddr
+	if r.Token != "" {
+		master, err := address.ParseAddr(r.Token)
+		if err != nil {
+			return err
+		}
+		r.master = master
+	}
+
+	switch r.Kind {
+	case alertKindCross:
+		if r.Price == nil || r.Price.Sign() <= 0 {
+			return errors.New("cross rule needs a positive price")
+		}
+	case alertKindChange:
+		if r.Percent <= 0 {
+			return errors.New("change rule needs a positive percent")
+		}
+
+		window, err := parseWindowDuration(r.Window)
+		if err != nil {
+			return err
+		}
+		r.window = window
+	default:
+		return fmt.Errorf("unknown kind %s, want %s or %s", r.Kind, alertKindCross, alertKindChange)
+	}
+
+	r.cooldown = alertCooldown
+	if r.Cooldown != "" {
+		cooldown, err := time.ParseDuration(r.Cooldown)
+		if err != nil {
+			return err
+		}
+		r.cooldown = cooldown
+	}
+
+	return nil
+}
+
+// comma separated webhook urls
+func parseWebhooks(s string) []string {
+	webhooks := make([]string, 0)
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			webhooks = append(webhooks, u)
+		}
+	}
+
+	return webhooks
+}
+
+func (ae *AlertEngine) PeriodicallyEvaluate() {
+	if len(ae.rules) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		ae.Evaluate(priceCollector.Snapshot(), time.Now())
+	}
+}
+
+// check every rule against fresh prices of ps, once per snapshot
+func (ae *AlertEngine) Evaluate(ps *PriceSnapshot, now time.Time) {
+	ae.mutex.Lock()
+	if ps.version == ae.version {
+		ae.mutex.Unlock()
+		return
+	}
+	ae.version = ps.version
+
+	fired := make([]fireAlert, 0)
+	for _, rule := range ae.rules {
+		c, ok := ps.price(rule.master)
+		if !ok || c.source.stale(now) {
+			continue
+		}
+
+		event, ok := rule.observe(c.value, now)
+		if !ok {
+			continue
+		}
+		// a crossing held back by the cooldown leaves the side as it was, so
+		// it fires once the cooldown is over if the price is still across
+		if !rule.lastFired.IsZero() && now.Sub(rule.lastFired) < rule.cooldown {
+			continue
+		}
+		rule.fired(event, now)
+
+		event.Type, event.Rule, event.Kind = alertEventType, rule.Name, rule.Kind
+		event.Master, event.Symbol = rule.master.String(), c.symbol
+		event.Block, event.At = c.source.block, now
+
+		ae.alerts = append(ae.alerts, event)
+		fired = append(fired, fireAlert{event: event, webhooks: append(append([]string{}, alertWebhooks...), rule.Webhooks...)})
+	}
+	if len(ae.alerts) > maxAlertHistory {
+		ae.alerts = ae.alerts[len(ae.alerts)-maxAlertHistory:]
+	}
+	ae.mutex.Unlock()
+
+	for _, f := range fired {
+		f.emit()
+	}
+}
+
+// fold price into rule state, an event when the rule condition is met
+func (r *AlertRule) observe(price Decimal, now time.Time) (AlertEvent, bool) {
+	switch r.Kind {
+	case alertKindCross:
+		// reaching the level counts as crossing it, the side only changes
+		// once the crossing fires
+		level := *r.Price
+		side := price.Cmp(level)
+		reached := side == 0 && !r.atLevel
+		switch {
+		case r.side < 0 && (side > 0 || reached):
+			return AlertEvent{PriceUSD: price, Direction: "up", From: level, ChangePercent: percentChange(level, price)}, true
+		case r.side > 0 && (side < 0 || reached):
+			return AlertEvent{PriceUSD: price, Direction: "down", From: level, ChangePercent: percentChange(level, price)}, true
+		}
+
+		// a price right at the level keeps the side it came from
+		if side != 0 {
+			r.side, r.atLevel = side, false
+		}
+	case alertKindChange:
+		r.observed = pruneObservations(append(r.observed, priceObservation{at: now, price: price}), now.Add(-r.window), false)
+
+		from := r.observed[0].price
+		change := percentChange(from, price)
+		if change >= r.Percent || change <= -r.Percent {
+			direction := "up"
+			if change < 0 {
+				direction = "down"
+			}
+			return AlertEvent{PriceUSD: price, Direction: direction, From: from, ChangePercent: change, Window: r.Window}, true
+		}
+	}
+
+	return AlertEvent{}, false
+}
+
+// a crossing moves the rule to the other side, a change is measured again
+// from the price it fired at
+func (r *AlertRule) fired(event AlertEvent, now time.Time) {
+	r.lastFired = now
+	if r.Kind == alertKindCross {
+		r.side, r.atLevel = 1, event.PriceUSD.Cmp(*r.Price) == 0
+		if event.Direction == "down" {
+			r.side = -1
+		}
+	}
+	if n := len(r.observed); n > 0 {
+		r.observed = r.observed[n-1:]
+	}
+}
+
+// (to - from) / from in percent
+func percentChange(from, to Decimal) float64 {
+	return to.Sub(from).Quo(from).Float64() * 100
+}
+
+type fireAlert struct {
+	event    AlertEvent
+	webhooks []string
+}
+
+// log, push to sse clients and post to webhooks
+func (f fireAlert) emit() {
+	e := f.event
+	log.Warn().Msgf("price alert %s: %s %s %s to %s (%+.2f%%)", e.Rule, e.Symbol, e.Direction, e.From.StringFixed(6, RoundHalfEven), e.PriceUSD.StringFixed(6, RoundHalfEven), e.ChangePercent)
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	sseEvents.Publish(alertEventType, e)
+
+	for _, u := range f.webhooks {
+		go postWebhook(u, payload)
+	}
+}
+
+func postWebhook(u string, payload []byte) {
+	resp, err := webhookClient.Post(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Warn().Err(err).Msgf("failed to post alert to %s", u)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Warn().Msgf("alert webhook %s returned %s", u, resp.Status)
+	}
+}
+
+// alerts fired so far, oldest first
+func (ae *AlertEngine) Alerts() []AlertEvent {
+	ae.mutex.Lock()
+	defer ae.mutex.Unlock()
+
+	return append(make([]AlertEvent, 0, len(ae.alerts)), ae.alerts...)
+}
+
+func handleAlerts(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, alertEngine.Alerts())
+}
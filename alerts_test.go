@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type alertStep struct {
+	after time.Duration
+	price int64
+}
+
+func TestAlertRules(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	defer func(s *SSEServer) { sseEvents = s }(sseEvents)
+	sseEvents = NewServer()
+
+	level := NewDecimal(5)
+	cases := []struct {
+		name  string
+		rule  AlertRule
+		steps []alertStep
+		want  string
+	}{
+		{"cross up", AlertRule{Kind: alertKindCross, Price: &level, Cooldown: "0s"},
+			[]alertStep{{0, 4}, {time.Minute, 6}}, "up"},
+		{"cross down", AlertRule{Kind: alertKindCross, Price: &level, Cooldown: "0s"},
+			[]alertStep{{0, 6}, {time.Minute, 4}}, "down"},
+		{"reaching the level crosses it once", AlertRule{Kind: alertKindCross, Price: &level, Cooldown: "0s"},
+			[]alertStep{{0, 4}, {time.Minute, 5}, {2 * time.Minute, 5}, {3 * time.Minute, 6}, {4 * time.Minute, 4}}, "up,down"},
+		{"falling back from the level crosses down", AlertRule{Kind: alertKindCross, Price: &level, Cooldown: "0s"},
+			[]alertStep{{0, 4}, {time.Minute, 5}, {2 * time.Minute, 4}}, "up,down"},
+		{"starting at the level takes no side", AlertRule{Kind: alertKindCross, Price: &level, Cooldown: "0s"},
+			[]alertStep{{0, 5}, {time.Minute, 6}, {2 * time.Minute, 5}}, "down"},
+		{"change within window", AlertRule{Kind: alertKindChange, Percent: 10, Window: "5m", Cooldown: "0s"},
+			[]alertStep{{0, 100}, {time.Minute, 105}, {2 * time.Minute, 111}}, "up"},
+		{"change measured again from the fired price", AlertRule{Kind: alertKindChange, Percent: 10, Window: "5m", Cooldown: "0s"},
+			[]alertStep{{0, 100}, {time.Minute, 111}, {2 * time.Minute, 115}, {3 * time.Minute, 99}}, "up,down"},
+		{"change outside window", AlertRule{Kind: alertKindChange, Percent: 10, Window: "5m", Cooldown: "0s"},
+			[]alertStep{{0, 100}, {10 * time.Minute, 115}}, ""},
+		{"cooldown holds a crossing back until it is over", AlertRule{Kind: alertKindCross, Price: &level, Cooldown: "15m"},
+			[]alertStep{{0, 4}, {time.Minute, 6}, {2 * time.Minute, 4}, {10 * time.Minute, 4}, {20 * time.Minute, 4}}, "up,down"},
+		{"crossing back within cooldown fires nothing", AlertRule{Kind: alertKindCross, Price: &level, Cooldown: "15m"},
+			[]alertStep{{0, 4}, {time.Minute, 6}, {2 * time.Minute, 4}, {3 * time.Minute, 6}, {20 * time.Minute, 6}}, "up"},
+		{"cooldown holds changes back", AlertRule{Kind: alertKindChange, Percent: 10, Window: "5m", Cooldown: "15m"},
+			[]alertStep{{0, 100}, {time.Minute, 111}, {2 * time.Minute, 123}}, "up"},
+	}
+
+	token := testAddr(10)
+	start := time.Now()
+	for _, c := range cases {
+		rule := c.rule
+		rule.Name, rule.Token = c.name, token.String()
+		if err := rule.init(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		ae := NewAlertEngine([]*AlertRule{&rule})
+		for i, step := range c.steps {
+			at := start.Add(step.after)
+			price := Currency{value: NewDecimal(step.price), source: priceSource{block: uint32(i + 1), at: at}}
+			ae.Evaluate(testSnapshot(uint64(i+1), at, map[addrKey]Currency{keyOf(token): price}), at)
+		}
+
+		directions := make([]string, 0)
+		for _, e := range ae.alerts {
+			directions = append(directions, e.Direction)
+		}
+		if got := strings.Join(directions, ","); got != c.want {
+			t.Errorf("%s: alerts %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/jetton"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+)
+
+// stablecoins paired with TON used to price TON in usd, symbol:master[:pool].
+// the pool is looked up through the STON.fi router when omitted
+var defaultStableAnchors = strings.Join([]string{
+	"USDT:EQCxE6mUtQJKFnGfaROTKOt1lZbDiiX1kCixRv7Nw2Id_sDs",
+	"jUSDT:EQBynBO23ywHy_CgarY9NK9FTz0yDsG82PtcbSTQgGoXwiuA:" + tonJUSDPoolAddr.String(),
+	"jUSDC:EQB-MPwrd1G6WKNkLz_VnV6WqBDd142KMQv-g1O-8QUA3728",
+}, ",")
+
+// a stablecoin whose implied TON price is further than this from the
+// combined TON price is considered off peg, 0.02 is 2%. overridden by flags
+var (
+	depegCheck     = false
+	depegThreshold = 0.02
+)
+
+var errNoAnchorPool = errors.New("stable anchor has no TON pool")
+
+type StableAnchor struct {
+	symbol string
+	master *address.Address
+	pool   *address.Address
+
+	// latest pool data, replaced on every successful refresh, and error of
+	// the last refresh
+	info *PoolInfo
+	err  error
+}
+
+type AnchorStatus struct {
+	Symbol string `json:"symbol"`
+	Master string `json:"master"`
+	Pool   string `json:"pool"`
+
+	// TON price in this stablecoin, assuming it is worth $1
+	TONPrice     float64 `json:"ton_price"`
+	LiquidityUSD float64 `json:"liquidity_usd"`
+	// usd price of the stablecoin itself, 1 unless off peg
+	PriceUSD float64 `json:"price_usd"`
+	Depegged bool    `json:"depegged"`
+	Outlier  bool    `json:"outlier"`
+
+	// pool data the status is based on, stale past priceMaxAge
+	Block     uint32    `json:"block"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Stale     bool      `json:"stale"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func parseStableAnchors(s string) ([]*StableAnchor, error) {
+	anchors := make([]*StableAnchor, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid stable anchor %s, want symbol:master[:pool]", item)
+		}
+
+		master, err := address.ParseAddr(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		anchor := &StableAnchor{symbol: parts[0], master: master}
+		if len(parts) == 3 {
+			if anchor.pool, err = address.ParseAddr(parts[2]); err != nil {
+				return nil, err
+			}
+		}
+		anchors = append(anchors, anchor)
+	}
+
+	if len(anchors) == 0 {
+		return nil, errors.New("at least one stable anchor is required")
+	}
+
+	return anchors, nil
+}
+
+// STON.fi v1 pool of TON and the anchor, from the router jetton wallets
+func (sa *StableAnchor) resolvePool(api ton.APIClientWrapped) error {
+	ctx := context.Background()
+	tonWallet, err := jetton.NewJettonMasterClient(api, tonMasterAddr).GetJettonWallet(ctx, stonfiAddr)
+	if err != nil {
+		return err
+	}
+
+	stableWallet, err := jetton.NewJettonMasterClient(api, sa.master).GetJettonWallet(ctx, stonfiAddr)
+	if err != nil {
+		return err
+	}
+
+	b, err := api.CurrentMasterchainInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	res, err := api.WaitForBlock(b.SeqNo).RunGetMethod(ctx, b, stonfiAddr, "get_pool_address",
+		cell.BeginCell().MustStoreAddr(tonWallet.Address()).EndCell().BeginParse(),
+		cell.BeginCell().MustStoreAddr(stableWallet.Address()).EndCell().BeginParse(),
+	)
+	if err != nil {
+		return err
+	}
+
+	slice, err := res.Slice(0)
+	if err != nil {
+		return err
+	}
+
+	sa.pool, err = slice.LoadAddr()
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("resolved %s TON pool %s", sa.symbol, sa.pool.String())
+	return nil
+}
+
+// fetch pool reserves and token masters, a fresh PoolInfo every time so
+// readers of the previous one are never affected
+func (sa *StableAnchor) refresh(api ton.APIClientWrapped) (*PoolInfo, error) {
+	if sa.pool == nil {
+		if err := sa.resolvePool(api); err != nil {
+			return nil, err
+		}
+	}
+
+	pool := &PoolInfo{addr: sa.pool}
+	if err := populateLPPoolInfo(api, sa.pool, pool); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if pool.token0JettonMaster, err = jettonMasterInfoByJettonWallet(api, pool.token0Address); err != nil {
+		return nil, err
+	}
+
+	if pool.token1JettonMaster, err = jettonMasterInfoByJettonWallet(api, pool.token1Address); err != nil {
+		return nil, err
+	}
+
+	if pool.masterIndex(sa.master) < 0 || pool.masterIndex(tonMasterAddr) < 0 {
+		return nil, fmt.Errorf("%s pool %s is not a TON pool of %s", sa.symbol, sa.pool.String(), sa.master.String())
+	}
+
+	return pool, nil
+}
+
+func (pi *PoolInfo) masterIndex(master *address.Address) int {
+	for i := 0; i < 2; i++ {
+		if m := pi.tokenMaster(i); m != nil && sameAddr(m.addr, master) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// TON price of a single anchor pool assuming the stable is at peg, with usd
+// depth of the stable side
+func (sa *StableAnchor) tonQuote(now time.Time) (*PoolPrice, error) {
+	pi := sa.info
+	if pi == nil || pi.reserve0 == nil || pi.reserve1 == nil || pi.reserve0.Sign() <= 0 || pi.reserve1.Sign() <= 0 {
+		return nil, errNoAnchorPool
+	}
+
+	if poolSource(pi).stale(now) {
+		return nil, errPriceStale
+	}
+
+	stable := pi.masterIndex(sa.master)
+	var value Decimal
+	reserve := pi.reserve0
+	if stable == 0 {
+		value = calculatePriceWithReserveP1(pi.reserve0, pi.reserve1, pi.token0JettonMaster.decimals, pi.token1JettonMaster.decimals, oneUSD)
+	} else {
+		value = calculatePriceWithReserveP0(pi.reserve0, pi.reserve1, pi.token0JettonMaster.decimals, pi.token1JettonMaster.decimals, oneUSD)
+		reserve = pi.reserve1
+	}
+
+	return &PoolPrice{
+		Pool:         pi.addr.String(),
+		Quote:        sa.master.String(),
+		PriceUSD:     value.Float64(),
+		LiquidityUSD: sideLiquidityUSD(reserve, pi.tokenMaster(stable).decimals, oneUSD),
+		Block:        pi.block,
+		value:        value,
+		source:       poolSource(pi),
+	}, nil
+}
+
+// combine anchor pools into one TON price: liquidity weighted over pools
+// close to the weighted median, so one broken or drained stable pool can't
+// move it. with depeg check on, stables off the combined price are priced
+// by their pool instead of $1. stale anchor pools are left out, when all of
+// them are stale TON is not priced
+func combineAnchors(anchors []*StableAnchor, now time.Time) ([]priceNode, []AnchorStatus) {
+	quotes := make([]PoolPrice, 0, len(anchors))
+	for _, sa := range anchors {
+		if q, err := sa.tonQuote(now); err == nil {
+			quotes = append(quotes, *q)
+		}
+	}
+
+	var ton Decimal
+	spread, ok := 0.0, false
+	if len(quotes) > 0 {
+		ton, spread, ok = aggregatePoolPrices(quotes)
+	}
+
+	quoteOf := make(map[string]PoolPrice)
+	for _, q := range quotes {
+		quoteOf[q.Pool] = q
+	}
+
+	nodes := make([]priceNode, 0, len(anchors)+1)
+	statuses := make([]AnchorStatus, 0, len(anchors))
+	liquidity := 0.0
+	for _, sa := range anchors {
+		price, source := oneUSD, priceSource{at: now}
+		status := AnchorStatus{Symbol: sa.symbol, Master: sa.master.String(), PriceUSD: 1}
+		if sa.err != nil {
+			status.Error = sa.err.Error()
+		}
+		if sa.info != nil {
+			status.Pool = sa.info.addr.String()
+			status.Block = sa.info.block
+			status.UpdatedAt = sa.info.updatedAt
+			status.Stale = poolSource(sa.info).stale(now)
+		}
+
+		if q, found := quoteOf[sa.info.addrString()]; found && ok {
+			status.TONPrice = q.PriceUSD
+			status.LiquidityUSD = q.LiquidityUSD
+			status.Outlier = q.Outlier
+			if !q.Outlier {
+				liquidity += q.LiquidityUSD
+			}
+
+			deviation := q.value.Sub(ton).Abs().Quo(ton)
+			if depegCheck && deviation.Cmp(DecimalFromFloat(depegThreshold)) > 0 {
+				// TON costs q.value of this stable but ton dollars
+				price, source = ton.Quo(q.value), q.source
+				status.PriceUSD = price.Float64()
+				status.Depegged = true
+				log.Warn().Msgf("%s looks off peg, TON is %s %s against %s usd", sa.symbol,
+					q.value.StringFixed(4, RoundHalfEven), sa.symbol, ton.StringFixed(4, RoundHalfEven))
+			}
+		}
+
+		nodes = append(nodes, stableNode(sa, price, source))
+		statuses = append(statuses, status)
+	}
+
+	if ok {
+		nodes = append(nodes, priceNode{
+			key: keyOf(tonMasterAddr),
+			currency: Currency{
+				symbol:  "TON",
+				decimal: 9,
+				value:   ton,
+				source:  quotesSource(quotes),
+				pools:   quotes,
+				spread:  spread,
+			},
+			liquidity: liquidity,
+		})
+	}
+
+	return nodes, statuses
+}
+
+func (pi *PoolInfo) addrString() string {
+	if pi == nil || pi.addr == nil {
+		return ""
+	}
+
+	return pi.addr.String()
+}
+
+func stableNode(sa *StableAnchor, price Decimal, source priceSource) priceNode {
+	decimals := 6
+	if sa.info != nil {
+		if m := sa.info.tokenMaster(sa.info.masterIndex(sa.master)); m != nil {
+			decimals = m.decimals
+		}
+	}
+
+	return priceNode{
+		key:       keyOf(sa.master),
+		currency:  Currency{symbol: sa.symbol, decimal: decimals, value: price, source: source},
+		liquidity: math.Inf(1),
+	}
+}
+
+func (pic *PriceCollector) Anchors() []AnchorStatus {
+	return append([]AnchorStatus(nil), pic.Snapshot().anchors...)
+}
+
+func handleAnchors(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, priceCollector.Anchors())
+}
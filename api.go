@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// http api served next to the sse stream, sse stays on "/" so existing
+// subscribers keep working, named json events are on "/events"
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lp", handleLPPositions)
+	mux.HandleFunc("/yield", handlePoolYield)
+	mux.HandleFunc("/quote", handleQuote)
+	mux.HandleFunc("/pool/changes", handlePoolChanges)
+	mux.HandleFunc("/depth", handleDepth)
+	mux.HandleFunc("/supply", handleSupply)
+	mux.HandleFunc("/token", handleTokenMarket)
+	mux.HandleFunc("/price", handlePrice)
+	mux.HandleFunc("/price/history", handlePriceHistory)
+	mux.HandleFunc("/anchors", handleAnchors)
+	mux.HandleFunc("/candles", handleCandles)
+	mux.HandleFunc("/candles/rebuild", handleCandlesRebuild)
+	mux.HandleFunc("/alerts", handleAlerts)
+	mux.HandleFunc("/cache", handleCache)
+	mux.HandleFunc("/cache/purge", handleCachePurge)
+	mux.Handle("/events", sseEvents)
+	mux.Handle("/", sse)
+
+	return mux
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.WriteHeader(status)
+
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Debug().Err(err).Msg("failed to write json response")
+	}
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+const candleEventType = "candles"
+
+// candle intervals, name and length
+var candleIntervals = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+	{"1h", time.Hour},
+	{"4h", 4 * time.Hour},
+	{"1d", 24 * time.Hour},
+}
+
+// candles kept per series and interval, older ones are dropped from memory
+// and from the candle log. trades are kept for tradeRetention so candles
+// can be rebuilt from them, overridden by flag in main
+var (
+	maxCandlesPerSeries = 1440
+	tradeRetention      = 30 * 24 * time.Hour
+)
+
+// how often updated candles are appended to the candle log
+var candlePersistInterval = time.Minute
+
+var errUnknownInterval = errors.New("unknown candle interval, want one of 1m, 5m, 15m, 1h, 4h, 1d")
+
+// a swap reduced to what candles need, stored so candles can be rebuilt
+type Trade struct {
+	Hash   string    `json:"hash"`
+	Pool   string    `json:"pool"`
+	At     time.Time `json:"at"`
+	Token0 string    `json:"token0"`
+	Token1 string    `json:"token1"`
+
+	// whole tokens sent to and paid out by the pool
+	Amount0 Decimal `json:"amount0"`
+	Amount1 Decimal `json:"amount1"`
+	// token0 in token1 the trade executed at, amount1 / amount0
+	Price0 Decimal `json:"price0"`
+
+	// oracle usd prices when the trade was seen, zero when unknown. token
+	// candles value each side at the other side's price, see executedUSD
+	Token0USD Decimal `json:"token0_usd"`
+	Token1USD Decimal `json:"token1_usd"`
+	TONUSD    Decimal `json:"ton_usd"`
+}
+
+type Candle struct {
+	Series   string    `json:"series"`
+	Interval string    `json:"interval"`
+	Start    time.Time `json:"start"`
+
+	Open  Decimal `json:"open"`
+	High  Decimal `json:"high"`
+	Low   Decimal `json:"low"`
+	Close Decimal `json:"close"`
+
+	Volume    Decimal `json:"volume"`
+	VolumeUSD Decimal `json:"volume_usd"`
+	Trades    int     `json:"trades"`
+
+	// trades may arrive out of order, open and close follow trade time
+	OpenAt  time.Time `json:"open_at"`
+	CloseAt time.Time `json:"close_at"`
+}
+
+type candleEvent struct {
+	Type    string    `json:"type"`
+	Candles []*Candle `json:"candles"`
+}
+
+// series names, pool prices are token0 in token1
+func poolSeries(pool *address.Address) string {
+	return "pool:" + keyOf(pool).String()
+}
+
+func tokenSeries(master *address.Address, quote string) string {
+	return "token:" + keyOf(master).String() + ":" + quote
+}
+
+func candleDuration(interval string) (time.Duration, bool) {
+	for _, ci := range candleIntervals {
+		if ci.name == interval {
+			return ci.duration, true
+		}
+	}
+
+	return 0, false
+}
+
+// trade of a settled swap, false before its payout or when the pool is
+// incomplete. amounts are what went in and what the pool paid out, so no
+// reserves read after the swap go into it
+func tradeOf(sa *SwapAction) (*Trade, bool) {
+	pi := sa.pool
+	if pi == nil || pi.addr == nil || pi.token0JettonMaster == nil || pi.token1JettonMaster == nil {
+		return nil, false
+	}
+	if sa.token0Coins == nil || sa.amountOut == nil || sa.token0Coins.Sign() <= 0 || sa.amountOut.Sign() <= 0 {
+		return nil, false
+	}
+
+	var from int
+	switch {
+	case sameAddr(sa.srcJetton, pi.token0Address):
+		from = 0
+	case sameAddr(sa.srcJetton, pi.token1Address):
+		from = 1
+	default:
+		return nil, false
+	}
+
+	d0, d1 := pi.token0JettonMaster.decimals, pi.token1JettonMaster.decimals
+	t := &Trade{
+		Hash:   base64.StdEncoding.EncodeToString(sa.hash),
+		Pool:   pi.addr.String(),
+		At:     time.Unix(int64(sa.now), 0).UTC(),
+		Token0: pi.token0JettonMaster.addr.String(),
+		Token1: pi.token1JettonMaster.addr.String(),
+		TONUSD: priceCollector.TonPrice(),
+	}
+
+	if from == 0 {
+		t.Amount0, t.Amount1 = DecimalFromUnits(sa.token0Coins, d0), DecimalFromUnits(sa.amountOut, d1)
+	} else {
+		t.Amount0, t.Amount1 = DecimalFromUnits(sa.amountOut, d0), DecimalFromUnits(sa.token0Coins, d1)
+	}
+	t.Price0 = t.Amount1.Quo(t.Amount0)
+
+	t.Token0USD, _ = priceCollector.TokenPrice(pi.token0JettonMaster)
+	t.Token1USD, _ = priceCollector.TokenPrice(pi.token1JettonMaster)
+
+	return t, true
+}
+
+// price, volume and usd volume of every series a trade moves
+type seriesPoint struct {
+	series    string
+	price     Decimal
+	volume    Decimal
+	volumeUSD Decimal
+}
+
+// usd prices both tokens executed at, what the other side paid for each
+// valued at the other token's usd price, zero when that is unknown
+func (t *Trade) executedUSD() (token0, token1 Decimal) {
+	if t.Amount0.Sign() <= 0 || t.Amount1.Sign() <= 0 {
+		return Decimal{}, Decimal{}
+	}
+
+	return t.Amount1.Quo(t.Amount0).Mul(t.Token1USD), t.Amount0.Quo(t.Amount1).Mul(t.Token0USD)
+}
+
+func (t *Trade) points() []seriesPoint {
+	pool, err0 := address.ParseAddr(t.Pool)
+	token0, err1 := address.ParseAddr(t.Token0)
+	token1, err2 := address.ParseAddr(t.Token1)
+	if err0 != nil || err1 != nil || err2 != nil {
+		return nil
+	}
+
+	volumeUSD := t.Amount0.Mul(t.Token0USD)
+	if t.Token0USD.Sign() == 0 {
+		volumeUSD = t.Amount1.Mul(t.Token1USD)
+	}
+
+	points := []seriesPoint{{series: poolSeries(pool), price: t.Price0, volume: t.Amount0, volumeUSD: volumeUSD}}
+	usd0, usd1 := t.executedUSD()
+	sides := []struct {
+		master *address.Address
+		usd    Decimal
+		amount Decimal
+	}{{token0, usd0, t.Amount0}, {token1, usd1, t.Amount1}}
+
+	for _, side := range sides {
+		if side.usd.Sign() <= 0 {
+			continue
+		}
+
+		points = append(points, seriesPoint{series: tokenSeries(side.master, "usd"), price: side.usd, volume: side.amount, volumeUSD: volumeUSD})
+		if t.TONUSD.Sign() > 0 {
+			points = append(points, seriesPoint{series: tokenSeries(side.master, "ton"), price: side.usd.Quo(t.TONUSD), volume: side.amount, volumeUSD: volumeUSD})
+		}
+	}
+
+	return points
+}
+
+// OHLCV candles per pool and per token in usd and TON at every interval
+type CandleAggregator struct {
+	mutex sync.Mutex
+	// series|interval -> candle start -> candle
+	candles map[string]map[int64]*Candle
+	// candles updated since the last persist, by candle key
+	dirty map[string]*Candle
+}
+
+func NewCandleAggregator() *CandleAggregator {
+	return &CandleAggregator{
+		mutex:   sync.Mutex{},
+		candles: make(map[string]map[int64]*Candle),
+		dirty:   make(map[string]*Candle),
+	}
+}
+
+// log the trade of a swap, update its candles and stream them
+func (ca *CandleAggregator) Record(sa *SwapAction) {
+	t, ok := tradeOf(sa)
+	if !ok {
+		return
+	}
+
+	// under mutex so a rebuild reading the trade log never folds this trade
+	// in a second time
+	ca.mutex.Lock()
+	tradeLog.Append(t.At, t)
+	updated := ca.apply(t, nil)
+	ca.mutex.Unlock()
+
+	sseEvents.Publish(candleEventType, candleEvent{Type: candleEventType, Candles: updated})
+}
+
+// fold trade into candles of intervals whose since it isn't before, all
+// with nil since. returns copies of the updated candles, called with mutex
+// held
+func (ca *CandleAggregator) apply(t *Trade, since map[string]time.Time) []*Candle {
+	updated := make([]*Candle, 0)
+	for _, p := range t.points() {
+		for _, ci := range candleIntervals {
+			if from, ok := since[ci.name]; ok && t.At.Before(from) {
+				continue
+			}
+
+			key := p.series + "|" + ci.name
+			series := ca.candles[key]
+			if series == nil {
+				series = make(map[int64]*Candle)
+				ca.candles[key] = series
+			}
+
+			start := t.At.Truncate(ci.duration)
+			c := series[start.Unix()]
+			if c == nil {
+				c = &Candle{Series: p.series, Interval: ci.name, Start: start}
+				series[start.Unix()] = c
+				ca.prune(series)
+			}
+			c.add(t.At, p)
+			ca.dirty[c.key()] = c
+
+			cp := *c
+			updated = append(updated, &cp)
+		}
+	}
+
+	return updated
+}
+
+func (c *Candle) add(at time.Time, p seriesPoint) {
+	if c.Trades == 0 {
+		c.Open, c.High, c.Low, c.Close = p.price, p.price, p.price, p.price
+		c.OpenAt, c.CloseAt = at, at
+	}
+
+	if at.Before(c.OpenAt) {
+		c.Open, c.OpenAt = p.price, at
+	}
+	if !at.Before(c.CloseAt) {
+		c.Close, c.CloseAt = p.price, at
+	}
+	if p.price.Cmp(c.High) > 0 {
+		c.High = p.price
+	}
+	if p.price.Cmp(c.Low) < 0 {
+		c.Low = p.price
+	}
+
+	c.Volume = c.Volume.Add(p.volume)
+	c.VolumeUSD = c.VolumeUSD.Add(p.volumeUSD)
+	c.Trades++
+}
+
+func (c *Candle) key() string {
+	return fmt.Sprintf("%s|%s|%012d", c.Series, c.Interval, c.Start.Unix())
+}
+
+// how long the candles of the longest interval are kept
+func candleRetention() time.Duration {
+	longest := candleIntervals[len(candleIntervals)-1].duration
+	return longest * time.Duration(maxCandlesPerSeries)
+}
+
+// drop oldest candles beyond maxCandlesPerSeries
+func (ca *CandleAggregator) prune(series map[int64]*Candle) {
+	if len(series) <= maxCandlesPerSeries {
+		return
+	}
+
+	starts := make([]int64, 0, len(series))
+	for start := range series {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	for _, start := range starts[:len(starts)-maxCandlesPerSeries] {
+		delete(series, start)
+	}
+}
+
+// candles of series at interval starting within [from, to], oldest first
+func (ca *CandleAggregator) Candles(series, interval string, from, to time.Time) []*Candle {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	candles := make([]*Candle, 0)
+	for _, c := range ca.candles[series+"|"+interval] {
+		if c.Start.Before(from) || c.Start.After(to) {
+			continue
+		}
+
+		cp := *c
+		candles = append(candles, &cp)
+	}
+	sort.Slice(candles, func(i, j int) bool { return candles[i].Start.Before(candles[j].Start) })
+
+	return candles
+}
+
+// append candles updated since the last persist to the candle log, each to
+// the segment of its start. a candle updated again is appended again, the
+// last line of it wins on load
+func (ca *CandleAggregator) Persist() {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	for _, c := range ca.dirty {
+		candleLog.Append(c.Start, c)
+	}
+	ca.dirty = make(map[string]*Candle)
+}
+
+func (ca *CandleAggregator) PeriodicallyPersist() {
+	ticker := time.NewTicker(candlePersistInterval)
+	for range ticker.C {
+		ca.Persist()
+	}
+}
+
+// load logged candles at startup, then compact the log to one line per
+// candle
+func (ca *CandleAggregator) Load(cl *SegmentLog) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	n := 0
+	err := cl.Each(func(value json.RawMessage) {
+		c := new(Candle)
+		if err := json.Unmarshal(value, c); err != nil {
+			return
+		}
+
+		key := c.Series + "|" + c.Interval
+		if ca.candles[key] == nil {
+			ca.candles[key] = make(map[int64]*Candle)
+		}
+		ca.candles[key][c.Start.Unix()] = c
+		n++
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to load candles from %s", cl.dir)
+		return
+	}
+
+	for _, series := range ca.candles {
+		ca.prune(series)
+	}
+
+	if err := cl.Rewrite(ca.byDay(time.Time{})); err != nil {
+		log.Error().Err(err).Msgf("failed to compact candles of %s", cl.dir)
+	}
+
+	log.Info().Msgf("loaded %d candles from %s", n, cl.dir)
+}
+
+// candles starting at or after from grouped by the segment day of their
+// start, called with mutex held
+func (ca *CandleAggregator) byDay(from time.Time) map[string][]interface{} {
+	days := make(map[string][]interface{})
+	for _, series := range ca.candles {
+		for _, c := range series {
+			if c.Start.Before(from) {
+				continue
+			}
+
+			day := segmentDay(c.Start)
+			days[day] = append(days[day], c)
+		}
+	}
+
+	return days
+}
+
+// rebuild the candles the logged trades fully cover, those starting at or
+// after the oldest trade, and rewrite the candle log. older candles outlived
+// the trades they were built from and are kept as they are
+func (ca *CandleAggregator) Rebuild(tl, cl *SegmentLog) (trades, candles int, err error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	var oldest time.Time
+	err = tl.Each(func(value json.RawMessage) {
+		var t struct {
+			At time.Time `json:"at"`
+		}
+		if err := json.Unmarshal(value, &t); err == nil && (oldest.IsZero() || t.At.Before(oldest)) {
+			oldest = t.At
+		}
+	})
+	if err != nil || oldest.IsZero() {
+		return 0, 0, err
+	}
+
+	// first candle start of each interval no trade is missing from
+	since := make(map[string]time.Time, len(candleIntervals))
+	for _, ci := range candleIntervals {
+		from := oldest.Truncate(ci.duration)
+		if from.Before(oldest) {
+			from = from.Add(ci.duration)
+		}
+		since[ci.name] = from
+	}
+
+	for _, series := range ca.candles {
+		for start, c := range series {
+			if !c.Start.Before(since[c.Interval]) {
+				delete(series, start)
+			}
+		}
+	}
+
+	err = tl.Each(func(value json.RawMessage) {
+		t := new(Trade)
+		if err := json.Unmarshal(value, t); err != nil {
+			return
+		}
+
+		ca.apply(t, since)
+		trades++
+	})
+	if err != nil {
+		return trades, 0, err
+	}
+
+	for _, series := range ca.candles {
+		for _, c := range series {
+			if !c.Start.Before(since[c.Interval]) {
+				candles++
+			}
+		}
+	}
+	// the rewrite below holds every candle
+	ca.dirty = make(map[string]*Candle)
+
+	return trades, candles, cl.Rewrite(ca.byDay(time.Time{}))
+}
+
+// POST /candles/rebuild, rebuilds go through the daemon so it keeps serving
+// and logging the rebuilt candles
+func handleCandlesRebuild(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+
+	if tradeLog == nil {
+		writeError(rw, http.StatusNotFound, errors.New("data dir is disabled"))
+		return
+	}
+
+	trades, candles, err := candleAggregator.Rebuild(tradeLog, candleLog)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]int{"trades": trades, "candles": candles})
+}
+
+// unix seconds or RFC3339, def when empty
+func parseTimeParam(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// /candles?pool=<pool>&interval=5m or /candles?token=<master>&quote=usd|ton,
+// optional from and to as unix seconds or RFC3339
+func handleCandles(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	var series string
+	switch {
+	case query.Get("pool") != "":
+		pool, err := address.ParseAddr(query.Get("pool"))
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		series = poolSeries(pool)
+	case query.Get("token") != "":
+		master, err := address.ParseAddr(query.Get("token"))
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+
+		quote := strings.ToLower(query.Get("quote"))
+		if quote == "" {
+			quote = "usd"
+		}
+		if quote != "usd" && quote != "ton" {
+			writeError(rw, http.StatusBadRequest, errors.New("quote must be usd or ton"))
+			return
+		}
+		series = tokenSeries(master, quote)
+	default:
+		writeError(rw, http.StatusBadRequest, errors.New("pool or token is required"))
+		return
+	}
+
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = candleIntervals[0].name
+	}
+	if _, ok := candleDuration(interval); !ok {
+		writeError(rw, http.StatusBadRequest, errUnknownInterval)
+		return
+	}
+
+	to, err := parseTimeParam(query.Get("to"), time.Now())
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	from, err := parseTimeParam(query.Get("from"), time.Time{})
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, candleAggregator.Candles(series, interval, from, to))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func testTrade(at time.Time, amount0, amount1 int64) *Trade {
+	return &Trade{
+		Pool:    testAddr(100).String(),
+		At:      at,
+		Token0:  testAddr(1).String(),
+		Token1:  testAddr(2).String(),
+		Amount0: NewDecimal(amount0),
+		Amount1: NewDecimal(amount1),
+		Price0:  NewDecimal(amount1).Quo(NewDecimal(amount0)),
+	}
+}
+
+// candles older than the oldest logged trade outlived their trades and
+// survive a rebuild, later ones are rebuilt from the trades alone
+func TestRebuildKeepsCandlesOlderThanTrades(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	tl, err := OpenSegmentLog(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := OpenSegmentLog(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	oldest := day.Add(time.Hour)
+	series := poolSeries(testAddr(100))
+
+	ca := NewCandleAggregator()
+	// traded before the oldest logged trade, its trades are gone
+	ca.apply(testTrade(day.Add(10*time.Minute), 1, 3), nil)
+	// counted twice before, the rebuild has to drop it
+	ca.apply(testTrade(oldest.Add(time.Minute), 1, 9), nil)
+	ca.apply(testTrade(oldest.Add(time.Minute), 1, 9), nil)
+
+	for _, trade := range []*Trade{testTrade(oldest, 1, 2), testTrade(oldest.Add(time.Minute), 1, 9)} {
+		tl.Append(trade.At, trade)
+	}
+
+	trades, _, err := ca.Rebuild(tl, cl)
+	if err != nil || trades != 2 {
+		t.Fatalf("rebuilt from %d trades, err %v", trades, err)
+	}
+
+	// the 1m candle of the oldest trade and the next one are rebuilt
+	minutes := ca.Candles(series, "1m", day, oldest.Add(time.Hour))
+	if len(minutes) != 3 || minutes[2].Trades != 1 || minutes[2].Close.Cmp(NewDecimal(9)) != 0 {
+		t.Fatalf("1m candles %+v", minutes)
+	}
+	if minutes[1].Close.Cmp(NewDecimal(2)) != 0 || minutes[0].Close.Cmp(NewDecimal(3)) != 0 {
+		t.Errorf("1m candle before the oldest trade %+v not kept", minutes[0])
+	}
+
+	// the day candle started before the oldest trade, it keeps its counts
+	days := ca.Candles(series, "1d", day, day)
+	if len(days) != 1 || days[0].Trades != 3 {
+		t.Errorf("1d candles %+v, want the one of the three earlier trades", days)
+	}
+
+	loaded := NewCandleAggregator()
+	loaded.Load(cl)
+	if got := loaded.Candles(series, "1m", time.Time{}, time.Now()); len(got) != 3 {
+		t.Errorf("loaded %d 1m candles from the rewritten log, want 3", len(got))
+	}
+}
+
+// token candles follow what the swap paid, not the oracle price it was
+// seen at
+func TestTokenCandlesUseExecutedPrices(t *testing.T) {
+	trade := testTrade(time.Now().UTC().Truncate(time.Minute), 10, 30)
+	// oracle says token0 is $2, but 10 of it bought 30 of token1 at $1
+	trade.Token0USD, trade.Token1USD, trade.TONUSD = NewDecimal(2), NewDecimal(1), NewDecimal(5)
+
+	if usd0, _ := trade.executedUSD(); usd0.Cmp(trade.Token0USD) == 0 {
+		t.Fatalf("executed price %s equals the oracle price", usd0)
+	}
+
+	ca := NewCandleAggregator()
+	ca.apply(trade, nil)
+
+	cases := []struct {
+		series string
+		want   Decimal
+	}{
+		{tokenSeries(testAddr(1), "usd"), NewDecimal(3)},
+		{tokenSeries(testAddr(1), "ton"), NewDecimal(3).Quo(NewDecimal(5))},
+		// 30 of token1 went for 10 of token0 at the $2 oracle price
+		{tokenSeries(testAddr(2), "usd"), NewDecimal(2).Quo(NewDecimal(3))},
+	}
+	for _, c := range cases {
+		candles := ca.Candles(c.series, "1m", time.Time{}, time.Now())
+		if len(candles) != 1 || candles[0].Close.Cmp(c.want) != 0 {
+			t.Errorf("%s candles %+v, want close %s", c.series, candles, c.want)
+		}
+	}
+}
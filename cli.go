@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+var cliClient = &http.Client{Timeout: time.Minute}
+
+// sub commands, they talk to a running dexstats through its http api
+// e.g. dexstats -host localhost -port 8080 lp EQ...
+func runCommand(args []string) error {
+	switch args[0] {
+	case "lp":
+		if len(args) != 2 {
+			return errors.New("usage: dexstats lp <wallet address>")
+		}
+		return apiGet("/lp", url.Values{"wallet": {args[1]}})
+	case "yield":
+		if len(args) > 2 {
+			return errors.New("usage: dexstats yield [pool address]")
+		}
+		query := url.Values{}
+		if len(args) == 2 {
+			query.Set("pool", args[1])
+		}
+		return apiGet("/yield", query)
+	case "quote":
+		if len(args) != 4 {
+			return errors.New("usage: dexstats quote <pool address> <from token> <amount>")
+		}
+		return apiGet("/quote", url.Values{"pool": {args[1]}, "from": {args[2]}, "amount": {args[3]}})
+	case "changes":
+		if len(args) != 2 {
+			return errors.New("usage: dexstats changes <pool address>")
+		}
+		return apiGet("/pool/changes", url.Values{"pool": {args[1]}})
+	case "depth":
+		query := url.Values{}
+		switch {
+		case len(args) == 1:
+		case len(args) == 3 && (args[1] == "pool" || args[1] == "token"):
+			query.Set(args[1], args[2])
+		default:
+			return errors.New("usage: dexstats depth [pool <pool address> | token <jetton master address>]")
+		}
+		return apiGet("/depth", query)
+	case "supply":
+		if len(args) != 2 {
+			return errors.New("usage: dexstats supply <jetton master address>")
+		}
+		return apiGet("/supply", url.Values{"token": {args[1]}})
+	case "token":
+		if len(args) != 2 {
+			return errors.New("usage: dexstats token <jetton master address>")
+		}
+		return apiGet("/token", url.Values{"token": {args[1]}})
+	case "price":
+		if len(args) != 2 {
+			return errors.New("usage: dexstats price <jetton master address>")
+		}
+		return apiGet("/price", url.Values{"token": {args[1]}})
+	case "history":
+		return runHistoryCommand(args[1:])
+	case "anchors":
+		return apiGet("/anchors", url.Values{})
+	case "alerts":
+		return apiGet("/alerts", url.Values{})
+	case "candles":
+		return runCandlesCommand(args[1:])
+	case "cache":
+		return runCacheCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+}
+
+// call dexstats http api and print indented json response to stdout
+func apiGet(path string, query url.Values) error {
+	return apiCall(http.MethodGet, path, query)
+}
+
+func apiPost(path string, query url.Values) error {
+	return apiCall(http.MethodPost, path, query)
+}
+
+func apiCall(method, path string, query url.Values) error {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     *host + ":" + *port,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cliClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	out.WriteTo(os.Stdout)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+
+	return nil
+}
+
+// cache stats of a running dexstats, inspect, export and purge the on-disk
+// store without one
+func runCacheCommand(args []string) error {
+	usage := errors.New("usage: dexstats cache stats | list <bucket> | export [file] | purge <bucket | expired | all>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	if args[0] == "stats" && len(args) == 1 {
+		return apiGet("/cache", url.Values{})
+	}
+
+	st, err := OpenStore(*storePath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		st.Each(args[1], func(key string, value json.RawMessage, expiresAt time.Time) {
+			fmt.Printf("%s\t%s\t%s\n", key, expiresAt.Format(time.RFC3339), value)
+		})
+		return nil
+	case args[0] == "export" && len(args) <= 2:
+		out := make(map[string]map[string]json.RawMessage)
+		for _, bucket := range st.Buckets() {
+			out[bucket] = make(map[string]json.RawMessage)
+			st.Each(bucket, func(key string, value json.RawMessage, _ time.Time) {
+				out[bucket][key] = value
+			})
+		}
+
+		body, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 2 {
+			return ioutil.WriteFile(args[1], body, storeFilePermission)
+		}
+		_, err = os.Stdout.Write(append(body, '\n'))
+		return err
+	case args[0] == "purge" && len(args) == 2:
+		// a running dexstats owns the store, purge through it
+		if err := st.Lock(); errors.Is(err, errStoreLocked) {
+			return apiPost("/cache/purge", url.Values{"bucket": {args[1]}})
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Printf("purged %d entries\n", st.PurgeBucket(args[1]))
+		return st.Flush()
+	default:
+		return usage
+	}
+}
+
+// query candles of a running dexstats, or rebuild the logged candles from
+// logged trades, through the running dexstats if there is one
+func runCandlesCommand(args []string) error {
+	usage := errors.New("usage: dexstats candles pool <pool address> <interval> [from] [to] | token <jetton master address> <usd|ton> <interval> [from] [to] | rebuild")
+
+	switch {
+	case len(args) == 1 && args[0] == "rebuild":
+		if *dataDir == "" {
+			return errors.New("data dir is disabled")
+		}
+
+		// a running dexstats owns the logs, rebuild through it
+		if err := openSegmentLogs(*dataDir); errors.Is(err, errStoreLocked) {
+			return apiPost("/candles/rebuild", url.Values{})
+		} else if err != nil {
+			return err
+		}
+
+		ca := NewCandleAggregator()
+		ca.Load(candleLog)
+		trades, candles, err := ca.Rebuild(tradeLog, candleLog)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rebuilt %d candles from %d trades\n", candles, trades)
+		return nil
+	case len(args) >= 3 && len(args) <= 5 && args[0] == "pool":
+		query := url.Values{"pool": {args[1]}, "interval": {args[2]}}
+		setRange(query, args[3:])
+		return apiGet("/candles", query)
+	case len(args) >= 4 && len(args) <= 6 && args[0] == "token":
+		query := url.Values{"token": {args[1]}, "quote": {args[2]}, "interval": {args[3]}}
+		setRange(query, args[4:])
+		return apiGet("/candles", query)
+	default:
+		return usage
+	}
+}
+
+// price history of a token at a resolution, or its price at a block
+func runHistoryCommand(args []string) error {
+	usage := errors.New("usage: dexstats history <jetton master address> [resolution] [from] [to] | history <jetton master address> block <seqno>")
+
+	switch {
+	case len(args) == 3 && args[1] == "block":
+		return apiGet("/price/history", url.Values{"token": {args[0]}, "block": {args[2]}})
+	case len(args) >= 1 && len(args) <= 4:
+		query := url.Values{"token": {args[0]}}
+		if len(args) > 1 {
+			query.Set("resolution", args[1])
+			setRange(query, args[2:])
+		}
+		return apiGet("/price/history", query)
+	default:
+		return usage
+	}
+}
+
+// optional from and to arguments
+func setRange(query url.Values, args []string) {
+	if len(args) > 0 {
+		query.Set("from", args[0])
+	}
+	if len(args) > 1 {
+		query.Set("to", args[1])
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// how exact values are rounded to a fixed number of decimal places
+type RoundingMode int
+
+const (
+	RoundDown     RoundingMode = iota // toward zero
+	RoundUp                           // away from zero
+	RoundFloor                        // toward negative infinity
+	RoundCeiling                      // toward positive infinity
+	RoundHalfUp                       // to nearest, ties away from zero
+	RoundHalfEven                     // to nearest, ties to even
+)
+
+// places used by Decimal.String, enough for prices of tokens worth fractions
+// of a nano dollar
+const decimalStringPlaces = 18
+
+var errInvalidDecimal = errors.New("invalid decimal")
+
+// exact decimal amount backed by a rational, prices derived from reserves
+// keep full precision and rounding only happens, with an explicit mode, when
+// converting back to integer units or formatting. the zero value is 0
+type Decimal struct {
+	r *big.Rat
+}
+
+func NewDecimal(v int64) Decimal {
+	return Decimal{r: new(big.Rat).SetInt64(v)}
+}
+
+// units of a token with decimals, e.g. 1500000000 with 9 decimals is 1.5
+func DecimalFromUnits(units *big.Int, decimals int) Decimal {
+	if units == nil {
+		return Decimal{}
+	}
+
+	return Decimal{r: new(big.Rat).SetFrac(units, pow10(decimals))}
+}
+
+// exact value of f, only for values that are floats already such as weights
+func DecimalFromFloat(f float64) Decimal {
+	r := new(big.Rat)
+	if r.SetFloat64(f) == nil {
+		return Decimal{}
+	}
+
+	return Decimal{r: r}
+}
+
+// parse "12", "-0.0005" or "3/7"
+func ParseDecimal(s string) (Decimal, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return Decimal{}, errInvalidDecimal
+	}
+
+	return Decimal{r: r}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func (d Decimal) rat() *big.Rat {
+	if d.r == nil {
+		return new(big.Rat)
+	}
+
+	return d.r
+}
+
+func (d Decimal) Add(o Decimal) Decimal {
+	return Decimal{r: new(big.Rat).Add(d.rat(), o.rat())}
+}
+
+func (d Decimal) Sub(o Decimal) Decimal {
+	return Decimal{r: new(big.Rat).Sub(d.rat(), o.rat())}
+}
+
+func (d Decimal) Mul(o Decimal) Decimal {
+	return Decimal{r: new(big.Rat).Mul(d.rat(), o.rat())}
+}
+
+// d / o, zero when o is zero
+func (d Decimal) Quo(o Decimal) Decimal {
+	if o.Sign() == 0 {
+		return Decimal{}
+	}
+
+	return Decimal{r: new(big.Rat).Quo(d.rat(), o.rat())}
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{r: new(big.Rat).Neg(d.rat())}
+}
+
+func (d Decimal) Abs() Decimal {
+	return Decimal{r: new(big.Rat).Abs(d.rat())}
+}
+
+func (d Decimal) Sign() int {
+	return d.rat().Sign()
+}
+
+func (d Decimal) Cmp(o Decimal) int {
+	return d.rat().Cmp(o.rat())
+}
+
+func (d Decimal) Float64() float64 {
+	f, _ := d.rat().Float64()
+	return f
+}
+
+// d in integer units of a token with decimals, rounded with mode
+func (d Decimal) Units(decimals int, mode RoundingMode) *big.Int {
+	r := d.rat()
+	num := new(big.Int).Mul(r.Num(), pow10(decimals))
+	return roundQuo(num, r.Denom(), mode)
+}
+
+// d rounded to places decimal places
+func (d Decimal) Round(places int, mode RoundingMode) Decimal {
+	return DecimalFromUnits(d.Units(places, mode), places)
+}
+
+// d with exactly places decimal places
+func (d Decimal) StringFixed(places int, mode RoundingMode) string {
+	u := d.Units(places, mode)
+
+	sign := ""
+	if u.Sign() < 0 {
+		sign = "-"
+		u = new(big.Int).Neg(u)
+	}
+
+	digits := u.String()
+	if places == 0 {
+		return sign + digits
+	}
+
+	if len(digits) <= places {
+		digits = strings.Repeat("0", places-len(digits)+1) + digits
+	}
+
+	return sign + digits[:len(digits)-places] + "." + digits[len(digits)-places:]
+}
+
+// d rounded half to even to decimalStringPlaces, trailing zeros removed
+func (d Decimal) String() string {
+	s := d.StringFixed(decimalStringPlaces, RoundHalfEven)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+
+	return s
+}
+
+// num / den rounded to an integer with mode, den must be positive
+func roundQuo(num, den *big.Int, mode RoundingMode) *big.Int {
+	q, m := new(big.Int).QuoRem(num, den, new(big.Int))
+	if m.Sign() == 0 {
+		return q
+	}
+
+	// QuoRem truncates toward zero, away moves one step away from it
+	sign := num.Sign()
+	away := false
+	switch mode {
+	case RoundDown:
+	case RoundUp:
+		away = true
+	case RoundFloor:
+		away = sign < 0
+	case RoundCeiling:
+		away = sign > 0
+	case RoundHalfUp, RoundHalfEven:
+		twice := new(big.Int).Mul(new(big.Int).Abs(m), big.NewInt(2))
+		switch twice.Cmp(den) {
+		case 1:
+			away = true
+		case 0:
+			away = mode == RoundHalfUp || q.Bit(0) == 1
+		}
+	}
+
+	if away {
+		q.Add(q, big.NewInt(int64(sign)))
+	}
+
+	return q
+}
+
+// json string of String, so values survive round trips through the store
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+
+	*d = v
+	return nil
+}
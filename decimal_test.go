@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"testing/quick"
+)
+
+var roundingModes = []RoundingMode{RoundDown, RoundUp, RoundFloor, RoundCeiling, RoundHalfUp, RoundHalfEven}
+
+// num / den rounded with mode, from floor division and comparisons of the
+// fraction with one half, independent of roundQuo's truncating QuoRem
+func referenceRound(num, den *big.Int, mode RoundingMode) *big.Int {
+	floor := new(big.Int).Div(num, den) // euclidean, floor for den > 0
+	frac := new(big.Rat).Sub(new(big.Rat).SetFrac(num, den), new(big.Rat).SetInt(floor))
+	if frac.Sign() == 0 {
+		return floor
+	}
+
+	ceil := new(big.Int).Add(floor, big.NewInt(1))
+	half := frac.Cmp(big.NewRat(1, 2))
+	negative := num.Sign() < 0
+
+	switch mode {
+	case RoundFloor:
+		return floor
+	case RoundCeiling:
+		return ceil
+	case RoundDown:
+		if negative {
+			return ceil
+		}
+		return floor
+	case RoundUp:
+		if negative {
+			return floor
+		}
+		return ceil
+	case RoundHalfUp:
+		if half > 0 || (half == 0 && !negative) {
+			return ceil
+		}
+		return floor
+	default:
+		if half > 0 || (half == 0 && floor.Bit(0) == 1) {
+			return ceil
+		}
+		return floor
+	}
+}
+
+func TestRoundQuoMatchesReference(t *testing.T) {
+	check := func(num int64, den uint32) bool {
+		d := big.NewInt(int64(den) + 1)
+		n := big.NewInt(num)
+
+		for _, mode := range roundingModes {
+			if got, want := roundQuo(n, d, mode), referenceRound(n, d, mode); got.Cmp(want) != 0 {
+				t.Logf("%d/%s mode %d: got %s, want %s", num, d, mode, got, want)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(check, &quick.Config{MaxCount: 20000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// small denominators hit exact halves, where half up and half even differ
+func TestRoundQuoHalves(t *testing.T) {
+	check := func(num int16, den uint8) bool {
+		d := big.NewInt(int64(den%4) + 1)
+		n := big.NewInt(int64(num))
+
+		for _, mode := range roundingModes {
+			if roundQuo(n, d, mode).Cmp(referenceRound(n, d, mode)) != 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(check, &quick.Config{MaxCount: 20000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStringFixedMatchesReference(t *testing.T) {
+	check := func(num int64, den uint32, places uint8) bool {
+		p := int(places % 20)
+		d := DecimalFromUnits(big.NewInt(num), 0).Quo(NewDecimal(int64(den) + 1))
+
+		for _, mode := range roundingModes {
+			r := d.rat()
+			want := referenceRound(new(big.Int).Mul(r.Num(), pow10(p)), r.Denom(), mode)
+
+			got, err := ParseDecimal(d.StringFixed(p, mode))
+			if err != nil || got.Cmp(DecimalFromUnits(want, p)) != 0 {
+				t.Logf("%s at %d places mode %d: got %s, want %s", d, p, mode, d.StringFixed(p, mode), DecimalFromUnits(want, p))
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(check, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecimalJSONRoundTrip(t *testing.T) {
+	check := func(num int64, den uint32) bool {
+		d := NewDecimal(num).Quo(DecimalFromUnits(big.NewInt(int64(den)+1), 3))
+
+		b, err := d.MarshalJSON()
+		if err != nil {
+			return false
+		}
+
+		var back Decimal
+		if err := back.UnmarshalJSON(b); err != nil {
+			return false
+		}
+
+		return back.Cmp(d.Round(decimalStringPlaces, RoundHalfEven)) == 0
+	}
+
+	if err := quick.Check(check, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+var depthImpacts = []float64{0.01, 0.02, 0.05}
+
+type DepthLevel struct {
+	Impact    float64 `json:"impact"`
+	AmountIn  string  `json:"amount_in"`
+	AmountOut string  `json:"amount_out"`
+}
+
+type PoolDepth struct {
+	Pool   string `json:"pool"`
+	Symbol string `json:"symbol"`
+	Token0 string `json:"token0"`
+	Token1 string `json:"token1"`
+
+	// token0 -> token1 and token1 -> token0
+	Sell0 []DepthLevel `json:"sell0"`
+	Sell1 []DepthLevel `json:"sell1"`
+}
+
+type TokenDepthLevel struct {
+	Impact float64 `json:"impact"`
+	// token amount that can be sold into / bought out of all its pools
+	Sell string `json:"sell"`
+	Buy  string `json:"buy"`
+
+	SellUSD *float64 `json:"sell_usd"`
+	BuyUSD  *float64 `json:"buy_usd"`
+}
+
+type TokenDepth struct {
+	Token        string            `json:"token"`
+	Master       string            `json:"master"`
+	Verification string            `json:"verification"`
+	Pools        []string          `json:"pools"`
+	Levels       []TokenDepthLevel `json:"levels"`
+}
+
+// with impact defined as in QuotePool, i.e. amountIn / (reserveIn + amountIn),
+// the largest input for an impact is p * reserveIn / (1 - p)
+func depthAmountIn(reserveIn *big.Int, impact float64) *big.Int {
+	amount, _ := new(big.Float).Quo(
+		new(big.Float).Mul(new(big.Float).SetInt(reserveIn), big.NewFloat(impact)),
+		big.NewFloat(1-impact),
+	).Int(nil)
+
+	return amount
+}
+
+func depthLevels(pool *PoolInfo, reserveIn, reserveOut *big.Int) []DepthLevel {
+	levels := make([]DepthLevel, 0, len(depthImpacts))
+	for _, impact := range depthImpacts {
+		amountIn := depthAmountIn(reserveIn, impact)
+		out, _, _ := expectedOutputs(amountIn, reserveIn, reserveOut, pool.lpFee, pool.protocolFee, pool.refFee, false)
+		levels = append(levels, DepthLevel{
+			Impact:    impact,
+			AmountIn:  amountIn.String(),
+			AmountOut: out.String(),
+		})
+	}
+
+	return levels
+}
+
+func PoolDepthOf(pool *PoolInfo) *PoolDepth {
+	if pool.reserve0 == nil || pool.reserve1 == nil || pool.reserve0.Sign() == 0 || pool.reserve1.Sign() == 0 {
+		return nil
+	}
+
+	return &PoolDepth{
+		Pool:   pool.addr.String(),
+		Symbol: pool.symbol,
+		Token0: pool.tokenSymbol(0),
+		Token1: pool.tokenSymbol(1),
+		Sell0:  depthLevels(pool, pool.reserve0, pool.reserve1),
+		Sell1:  depthLevels(pool, pool.reserve1, pool.reserve0),
+	}
+}
+
+func AllPoolDepth() []*PoolDepth {
+	depths := make([]*PoolDepth, 0)
+	for _, pool := range priceCollector.Pools() {
+		if depth := PoolDepthOf(pool); depth != nil {
+			depths = append(depths, depth)
+		}
+	}
+
+	sort.Slice(depths, func(i, j int) bool {
+		return depths[i].Pool < depths[j].Pool
+	})
+
+	return depths
+}
+
+// sum depth of token over every pool it trades in, token is identified by
+// its jetton master, symbols are not unique across pools
+func TokenDepthOf(token *address.Address) *TokenDepth {
+	var (
+		td     *TokenDepth
+		master *JettonMasterInfo
+		sell   = make([]*big.Int, len(depthImpacts))
+		buy    = make([]*big.Int, len(depthImpacts))
+	)
+
+	for i := range depthImpacts {
+		sell[i], buy[i] = new(big.Int), new(big.Int)
+	}
+
+	for _, pool := range priceCollector.Pools() {
+		i := -1
+		for j, poolMaster := range []*JettonMasterInfo{pool.token0JettonMaster, pool.token1JettonMaster} {
+			if poolMaster != nil && sameAddr(poolMaster.addr, token) {
+				i, master = j, poolMaster
+			}
+		}
+
+		depth := PoolDepthOf(pool)
+		if i < 0 || depth == nil {
+			continue
+		}
+
+		if td == nil {
+			td = &TokenDepth{Token: master.symbol, Master: master.addr.String(), Verification: master.Verification()}
+		}
+		td.Pools = append(td.Pools, depth.Pool)
+
+		sells, buys := depth.Sell0, depth.Sell1
+		if i == 1 {
+			sells, buys = depth.Sell1, depth.Sell0
+		}
+
+		for l := range depthImpacts {
+			in, _ := new(big.Int).SetString(sells[l].AmountIn, 10)
+			out, _ := new(big.Int).SetString(buys[l].AmountOut, 10)
+			sell[l].Add(sell[l], in)
+			buy[l].Add(buy[l], out)
+		}
+	}
+
+	if td == nil {
+		return nil
+	}
+
+	for l, impact := range depthImpacts {
+		level := TokenDepthLevel{
+			Impact: impact,
+			Sell:   sell[l].String(),
+			Buy:    buy[l].String(),
+		}
+
+		if v, ok := priceCollector.USDValue(master, sell[l]); ok {
+			level.SellUSD = &v
+		}
+
+		if v, ok := priceCollector.USDValue(master, buy[l]); ok {
+			level.BuyUSD = &v
+		}
+
+		td.Levels = append(td.Levels, level)
+	}
+
+	return td
+}
+
+// log depth of every known pool at interval, disabled if interval is 0
+func PeriodicallyReportDepth(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		for _, depth := range AllPoolDepth() {
+			var sb strings.Builder
+			for l, impact := range depthImpacts {
+				sb.WriteString(fmt.Sprintf(" %.0f%%: %s %s / %s %s", impact*100,
+					depth.Sell0[l].AmountIn, depth.Token0,
+					depth.Sell1[l].AmountIn, depth.Token1))
+			}
+
+			log.Info().Msgf("depth %s (%s)%s", depth.Symbol, ss(depth.Pool), sb.String())
+		}
+	}
+}
+
+// depth of one pool, one token across pools, or all pools if no argument given
+func handleDepth(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	if tokenParam := query.Get("token"); tokenParam != "" {
+		token, err := address.ParseAddr(tokenParam)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+
+		td := TokenDepthOf(token)
+		if td == nil {
+			writeError(rw, http.StatusNotFound, errUnknownPoolToken)
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, td)
+		return
+	}
+
+	if poolParam := query.Get("pool"); poolParam != "" {
+		poolAddr, err := address.ParseAddr(poolParam)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+
+		pool := priceCollector.GetItem(poolAddr.String())
+		if pool == nil {
+			writeError(rw, http.StatusNotFound, errPoolNotFound)
+			return
+		}
+
+		depth := PoolDepthOf(pool)
+		if depth == nil {
+			writeError(rw, http.StatusNotFound, errPoolNotFound)
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, depth)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, AllPoolDepth())
+}
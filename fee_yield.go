@@ -0,0 +1,254 @@
+package main
+
+import (
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+var (
+	yieldWindows        = []time.Duration{24 * time.Hour, 7 * 24 * time.Hour}
+	yieldRetention      = 7 * 24 * time.Hour
+	year                = 365 * 24 * time.Hour
+	maxProtocolFeePoint = 2048
+
+	// share of a window that must have been observed before its APR is
+	// given, a few swaps right after startup would annualize to nonsense
+	minYieldCoverage = 0.8
+)
+
+// one swap into a pool, only one of the amounts is set
+type feeSample struct {
+	at       time.Time
+	token0In *big.Int
+	token1In *big.Int
+}
+
+type protocolFeeSample struct {
+	At     time.Time `json:"at"`
+	Token0 string    `json:"token0"`
+	Token1 string    `json:"token1"`
+}
+
+type PoolYieldWindow struct {
+	Window string `json:"window"`
+	Swaps  int    `json:"swaps"`
+
+	// volume and LP fees valued in token0 at current pool price
+	VolumeToken0 string `json:"volume_token0"`
+	FeesToken0   string `json:"fees_token0"`
+
+	// annualized LP fees over pool liquidity, nil until Coverage reaches
+	// minYieldCoverage
+	APR      *float64 `json:"apr"`
+	Coverage float64  `json:"coverage"`
+
+	FeesUSD *float64 `json:"fees_usd"`
+}
+
+type PoolYield struct {
+	Pool   string `json:"pool"`
+	Symbol string `json:"symbol"`
+
+	LPFee       int64 `json:"lp_fee"`
+	ProtocolFee int64 `json:"protocol_fee"`
+	RefFee      int64 `json:"ref_fee"`
+
+	Windows []PoolYieldWindow `json:"windows"`
+
+	ProtocolFeeAccrual []protocolFeeSample `json:"protocol_fee_accrual,omitempty"`
+}
+
+// track swap volume and protocol fees per pool, estimate LP fee yield from them
+type FeeTracker struct {
+	mutex     sync.Mutex
+	startedAt time.Time
+	swaps     map[string][]feeSample
+	accruals  map[string][]protocolFeeSample
+}
+
+func NewFeeTracker() *FeeTracker {
+	return &FeeTracker{
+		mutex:     sync.Mutex{},
+		startedAt: time.Now(),
+		swaps:     make(map[string][]feeSample),
+		accruals:  make(map[string][]protocolFeeSample),
+	}
+}
+
+// record swap volume and protocol fee counters from a swap action
+func (ft *FeeTracker) Record(sa *SwapAction) {
+	if sa.pool == nil || sa.pool.addr == nil {
+		return
+	}
+
+	key := sa.pool.addr.String()
+	now := time.Now()
+
+	sample := feeSample{at: now}
+	switch {
+	case sameAddr(sa.srcJetton, sa.pool.token0Address):
+		sample.token0In = sa.token0Coins
+	case sameAddr(sa.srcJetton, sa.pool.token1Address):
+		sample.token1In = sa.token0Coins
+	default:
+		return
+	}
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	ft.swaps[key] = append(ft.prune(ft.swaps[key], now), sample)
+
+	if sa.pool.collectedToken0ProtocolFee != nil && sa.pool.collectedToken1ProtocolFee != nil {
+		accrual := append(ft.accruals[key], protocolFeeSample{
+			At:     now,
+			Token0: sa.pool.collectedToken0ProtocolFee.String(),
+			Token1: sa.pool.collectedToken1ProtocolFee.String(),
+		})
+		if len(accrual) > maxProtocolFeePoint {
+			accrual = accrual[len(accrual)-maxProtocolFeePoint:]
+		}
+		ft.accruals[key] = accrual
+	}
+}
+
+// drop samples older than retention, samples are in time order
+func (ft *FeeTracker) prune(samples []feeSample, now time.Time) []feeSample {
+	i := 0
+	for i < len(samples) && now.Sub(samples[i].at) > yieldRetention {
+		i++
+	}
+
+	return samples[i:]
+}
+
+func (ft *FeeTracker) Yield(pool *PoolInfo, withAccrual bool) *PoolYield {
+	key := pool.addr.String()
+	now := time.Now()
+
+	ft.mutex.Lock()
+	samples := append([]feeSample(nil), ft.swaps[key]...)
+	accrual := append([]protocolFeeSample(nil), ft.accruals[key]...)
+	ft.mutex.Unlock()
+
+	py := &PoolYield{
+		Pool:        key,
+		Symbol:      pool.symbol,
+		LPFee:       pool.lpFee,
+		ProtocolFee: pool.protocolFee,
+		RefFee:      pool.refFee,
+	}
+
+	if withAccrual {
+		py.ProtocolFeeAccrual = accrual
+	}
+
+	for _, window := range yieldWindows {
+		py.Windows = append(py.Windows, ft.window(pool, samples, window, now))
+	}
+
+	return py
+}
+
+func (ft *FeeTracker) window(pool *PoolInfo, samples []feeSample, window time.Duration, now time.Time) PoolYieldWindow {
+	w := PoolYieldWindow{Window: window.String()}
+
+	token0In, token1In := new(big.Int), new(big.Int)
+	for _, sample := range samples {
+		if now.Sub(sample.at) > window {
+			continue
+		}
+
+		w.Swaps++
+		if sample.token0In != nil {
+			token0In.Add(token0In, sample.token0In)
+		}
+		if sample.token1In != nil {
+			token1In.Add(token1In, sample.token1In)
+		}
+	}
+
+	if pool.reserve0 == nil || pool.reserve1 == nil || pool.reserve0.Sign() == 0 || pool.reserve1.Sign() == 0 {
+		return w
+	}
+
+	// token1 converted to token0 at current pool price
+	volume := new(big.Int).Add(token0In, new(big.Int).Div(new(big.Int).Mul(token1In, pool.reserve0), pool.reserve1))
+	fees := new(big.Int).Div(new(big.Int).Mul(volume, big.NewInt(pool.lpFee)), big.NewInt(feeDivider))
+	w.VolumeToken0 = volume.String()
+	w.FeesToken0 = fees.String()
+
+	// annualize over the time we actually observed if shorter than the window
+	span := window
+	if observed := now.Sub(ft.startedAt); observed < span {
+		span = observed
+	}
+	w.Coverage = float64(span) / float64(window)
+
+	if w.Coverage >= minYieldCoverage {
+		tvl := new(big.Float).SetInt(new(big.Int).Mul(pool.reserve0, big.NewInt(2)))
+		ratio, _ := new(big.Float).Quo(new(big.Float).SetInt(fees), tvl).Float64()
+		apr := ratio * float64(year) / float64(span)
+		w.APR = &apr
+	}
+
+	if v, ok := priceCollector.USDValue(pool.token0JettonMaster, fees); ok {
+		w.FeesUSD = &v
+	}
+
+	return w
+}
+
+// all known pools ranked by 24h APR, pools without one last
+func (ft *FeeTracker) Ranked() []*PoolYield {
+	yields := make([]*PoolYield, 0)
+	for _, pool := range priceCollector.Pools() {
+		yields = append(yields, ft.Yield(pool, false))
+	}
+
+	sort.SliceStable(yields, func(i, j int) bool {
+		a, b := yields[i].Windows[0].APR, yields[j].Windows[0].APR
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return *a > *b
+	})
+
+	return yields
+}
+
+func sameAddr(a, b *address.Address) bool {
+	if a == nil || b == nil {
+		return false
+	}
+
+	return keyOf(a) == keyOf(b)
+}
+
+// ranked pools, or a single pool with protocol fee accrual if pool is given
+func handlePoolYield(rw http.ResponseWriter, req *http.Request) {
+	poolParam := req.URL.Query().Get("pool")
+	if poolParam == "" {
+		writeJSON(rw, http.StatusOK, feeTracker.Ranked())
+		return
+	}
+
+	poolAddr, err := address.ParseAddr(poolParam)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	pool := priceCollector.GetItem(poolAddr.String())
+	if pool == nil {
+		writeError(rw, http.StatusNotFound, errPoolNotFound)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, feeTracker.Yield(pool, true))
+}
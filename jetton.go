@@ -1,15 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"container/list"
 	"fmt"
-	"io/ioutil"
 	"math/big"
-	"net/http"
-	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/xssnick/tonutils-go/address"
@@ -28,71 +24,125 @@ type JettonMasterInfo struct {
 	description string
 	decimals    int
 	image       string
+	imageData   []byte
+	amountStyle string
+	renderType  string
+
+	// set by tokenVerifier
+	verified   bool
+	suspicious bool
+	flags      []string
 }
 
-func (info *JettonMasterInfo) FetchJettonMasterConfigFromURL() error {
-	log.Debug().Msgf("fetching info from %s", info.offChainURI)
-
-	var body []byte
-	if masterOffChainDataCache.Get(info.offChainURI) != nil {
-		body = masterOffChainDataCache.Get(info.offChainURI)
-	} else {
-		now := time.Now()
-		resp, err := http.Get(info.offChainURI)
-		if err != nil {
-			return err
-		}
-		log.Debug().Msgf("fetching info from %s done take %d ms", info.offChainURI, time.Since(now).Milliseconds())
+// persisted form of JettonMasterInfo
+type jettonMasterRecord struct {
+	Addr        string `json:"addr"`
+	OffChainURI string `json:"offchain_uri"`
+	TotalSupply string `json:"total_supply"`
+	Mintable    bool   `json:"mintable"`
+	AdminAddr   string `json:"admin_addr"`
 
-		defer resp.Body.Close()
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
+	Symbol      string `json:"symbol"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Decimals    int    `json:"decimals"`
+	Image       string `json:"image"`
+	ImageData   []byte `json:"image_data,omitempty"`
+	AmountStyle string `json:"amount_style,omitempty"`
+	RenderType  string `json:"render_type,omitempty"`
+}
 
-		masterOffChainDataCache.Set(info.offChainURI, body)
+func (info *JettonMasterInfo) record() jettonMasterRecord {
+	r := jettonMasterRecord{
+		Addr:        info.addr.String(),
+		OffChainURI: info.offChainURI,
+		Mintable:    info.mintable,
+		Symbol:      info.symbol,
+		Name:        info.name,
+		Description: info.description,
+		Decimals:    info.decimals,
+		Image:       info.image,
+		ImageData:   info.imageData,
+		AmountStyle: info.amountStyle,
+		RenderType:  info.renderType,
 	}
 
-	type Content struct {
-		Symbol      string `json:"symbol"`
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Decimals    string `json:"decimals"`
-		Image       string `json:"image"`
+	if info.totalSupply != nil {
+		r.TotalSupply = info.totalSupply.String()
 	}
 
-	type ContentIntDecimal struct {
-		Symbol      string `json:"symbol"`
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Decimals    int    `json:"decimals"`
-		Image       string `json:"image"`
+	if info.adminAddr != nil {
+		r.AdminAddr = info.adminAddr.String()
 	}
 
-	var content Content
-	err := json.Unmarshal(body, &content)
+	return r
+}
+
+func (r jettonMasterRecord) info() (*JettonMasterInfo, error) {
+	addr, err := address.ParseAddr(r.Addr)
 	if err != nil {
-		var ci ContentIntDecimal
-		err = json.Unmarshal(body, &ci)
-		if err != nil {
-			return err
+		return nil, err
+	}
+
+	info := &JettonMasterInfo{
+		addr:        addr,
+		offChainURI: r.OffChainURI,
+		totalSupply: new(big.Int),
+		mintable:    r.Mintable,
+		symbol:      r.Symbol,
+		name:        r.Name,
+		description: r.Description,
+		decimals:    r.Decimals,
+		image:       r.Image,
+		imageData:   r.ImageData,
+		amountStyle: r.AmountStyle,
+		renderType:  r.RenderType,
+	}
+
+	if r.TotalSupply != "" {
+		if _, ok := info.totalSupply.SetString(r.TotalSupply, 10); !ok {
+			return nil, fmt.Errorf("invalid total supply %s", r.TotalSupply)
+		}
+	}
+
+	if r.AdminAddr != "" {
+		if info.adminAddr, err = address.ParseAddr(r.AdminAddr); err != nil {
+			return nil, err
 		}
-		info.decimals = ci.Decimals
-		info.image = ci.Image
-		info.symbol = ci.Symbol
-		info.name = ci.Name
-		info.description = ci.Description
-	} else {
-		info.symbol = content.Symbol
-		info.name = content.Name
-		info.description = content.Description
-		info.decimals, _ = strconv.Atoi(content.Decimals)
-		info.image = content.Image
 	}
 
+	return info, nil
+}
+
+func (info *JettonMasterInfo) FetchJettonMasterConfigFromURL() error {
+	m, err := fetchOffChainMetadata(info.offChainURI)
+	if err != nil {
+		return err
+	}
+
+	info.applyMetadata(m)
 	return nil
 }
 
+// fetch and parse off-chain metadata json, bodies are cached by uri
+func fetchOffChainMetadata(uri string) (tep64Metadata, error) {
+	log.Debug().Msgf("fetching info from %s", uri)
+
+	body := masterOffChainDataCache.Get(uri)
+	if body == nil {
+		var err error
+		body, err = metadataFetcher.Fetch(uri)
+		if err != nil {
+			return tep64Metadata{}, err
+		}
+
+		masterOffChainDataCache.Set(uri, body)
+		store.Set(bucketOffChainBody, uri, string(body), offChainBodyTTL)
+	}
+
+	return offchainMetadata(body)
+}
+
 func (ji *JettonMasterInfo) String() string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("addr: %s\n", ji.addr.String()))
@@ -104,22 +154,87 @@ func (ji *JettonMasterInfo) String() string {
 	sb.WriteString(fmt.Sprintf("name: %s\n", ji.name))
 	sb.WriteString(fmt.Sprintf("description: %s\n", ji.description))
 	sb.WriteString(fmt.Sprintf("decimals: %d\n", ji.decimals))
+	if len(ji.imageData) > 0 {
+		sb.WriteString(fmt.Sprintf("imageData: %d bytes\n", len(ji.imageData)))
+	}
+	sb.WriteString(fmt.Sprintf("verification: %s\n", ji.Verification()))
+	if len(ji.flags) > 0 {
+		sb.WriteString(fmt.Sprintf("flags: %s\n", strings.Join(ji.flags, ",")))
+	}
 
 	return sb.String()
 }
 
+// addresses parsed from different messages are different pointers,
+// key them by raw workchain and account hash instead
+type addrKey struct {
+	workchain int32
+	hash      [32]byte
+}
+
+func keyOf(addr *address.Address) addrKey {
+	k := addrKey{workchain: addr.Workchain()}
+	copy(k.hash[:], addr.Data())
+	return k
+}
+
+func (k addrKey) String() string {
+	return fmt.Sprintf("%d:%x", k.workchain, k.hash)
+}
+
+func parseAddrKey(s string) (addrKey, error) {
+	var k addrKey
+	var hash []byte
+	if _, err := fmt.Sscanf(s, "%d:%x", &k.workchain, &hash); err != nil {
+		return k, err
+	}
+
+	if len(hash) != len(k.hash) {
+		return k, fmt.Errorf("invalid address key %s", s)
+	}
+	copy(k.hash[:], hash)
+
+	return k, nil
+}
+
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+func (cs CacheStats) String() string {
+	return fmt.Sprintf("size %d/%d, hits %d, misses %d, evictions %d", cs.Size, cs.Capacity, cs.Hits, cs.Misses, cs.Evictions)
+}
+
+type walletMasterEntry struct {
+	key    addrKey
+	master *address.Address
+}
+
 // use to cache jetton addr to jetton master addr cache
 // jetton addr are those store in a pool
 // jetton master addr are corresponding jetton master, save get_jetton_data request
+// least recently used entries are evicted once capacity is reached
 type JettonWalletJettonMasterAddrCache struct {
-	mutex sync.Mutex
-	m     map[*address.Address]*address.Address
+	mutex    sync.Mutex
+	capacity int
+	ll       *list.List
+	m        map[addrKey]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
 }
 
-func NewJettonWalletJettonMasterAddrCache() *JettonWalletJettonMasterAddrCache {
+func NewJettonWalletJettonMasterAddrCache(capacity int) *JettonWalletJettonMasterAddrCache {
 	return &JettonWalletJettonMasterAddrCache{
-		mutex: sync.Mutex{},
-		m:     make(map[*address.Address]*address.Address),
+		mutex:    sync.Mutex{},
+		capacity: capacity,
+		ll:       list.New(),
+		m:        make(map[addrKey]*list.Element),
 	}
 }
 
@@ -127,13 +242,49 @@ func (c *JettonWalletJettonMasterAddrCache) Get(addr *address.Address) *address.
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	return c.m[addr]
+	el, ok := c.m[keyOf(addr)]
+	if !ok {
+		c.misses++
+		return nil
+	}
+
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*walletMasterEntry).master
 }
 
 func (c *JettonWalletJettonMasterAddrCache) Set(addr *address.Address, masterAddr *address.Address) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.m[addr] = masterAddr
+
+	key := keyOf(addr)
+	if el, ok := c.m[key]; ok {
+		el.Value.(*walletMasterEntry).master = masterAddr
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.m[key] = c.ll.PushFront(&walletMasterEntry{key: key, master: masterAddr})
+
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.m, oldest.Value.(*walletMasterEntry).key)
+		c.evictions++
+	}
+}
+
+func (c *JettonWalletJettonMasterAddrCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{
+		Size:      c.ll.Len(),
+		Capacity:  c.capacity,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
 }
 
 // use to cache jetton master addr to jetton master offchain data cache
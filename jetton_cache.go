@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/jetton"
+)
+
+// a failed supply refresh is retried after this, not on the next swap
+var supplyRetryDelay = 10 * time.Second
+
+type jettonMasterEntry struct {
+	info       *JettonMasterInfo
+	metadataAt time.Time
+	supplyAt   time.Time
+}
+
+// one in flight lookup, later callers for the same master wait on it
+type jettonMasterCall struct {
+	wg   sync.WaitGroup
+	info *JettonMasterInfo
+	err  error
+}
+
+// cache parsed jetton master info
+// static metadata (symbol, name, decimals...) is refreshed every metadataTTL,
+// totalSupply, mintable and adminAddr every supplyTTL.
+// cached info is never mutated, a refresh replaces it with a copy
+type JettonMasterInfoCache struct {
+	metadataTTL time.Duration
+	supplyTTL   time.Duration
+
+	mutex    sync.Mutex
+	m        map[addrKey]*jettonMasterEntry
+	inflight map[addrKey]*jettonMasterCall
+}
+
+func NewJettonMasterInfoCache() *JettonMasterInfoCache {
+	return &JettonMasterInfoCache{
+		metadataTTL: time.Hour * 24,
+		supplyTTL:   time.Minute,
+		mutex:       sync.Mutex{},
+		m:           make(map[addrKey]*jettonMasterEntry),
+		inflight:    make(map[addrKey]*jettonMasterCall),
+	}
+}
+
+func (c *JettonMasterInfoCache) Get(api ton.APIClientWrapped, masterAddr *address.Address) (*JettonMasterInfo, error) {
+	key := keyOf(masterAddr)
+	now := time.Now()
+
+	c.mutex.Lock()
+	entry := c.m[key]
+	if entry != nil && now.Sub(entry.metadataAt) < c.metadataTTL && now.Sub(entry.supplyAt) < c.supplyTTL {
+		c.mutex.Unlock()
+		return entry.info, nil
+	}
+
+	if call, ok := c.inflight[key]; ok {
+		c.mutex.Unlock()
+		call.wg.Wait()
+		return call.info, call.err
+	}
+
+	call := new(jettonMasterCall)
+	call.wg.Add(1)
+	c.inflight[key] = call
+	c.mutex.Unlock()
+
+	call.info, call.err = c.load(api, masterAddr, entry)
+
+	c.mutex.Lock()
+	delete(c.inflight, key)
+	c.mutex.Unlock()
+	call.wg.Done()
+
+	return call.info, call.err
+}
+
+// refresh what is stale in entry, entry is nil on a miss
+func (c *JettonMasterInfoCache) load(api ton.APIClientWrapped, masterAddr *address.Address, entry *jettonMasterEntry) (*JettonMasterInfo, error) {
+	key := keyOf(masterAddr)
+	now := time.Now()
+
+	// warm start from store, its supply is considered stale
+	if entry == nil {
+		var record jettonMasterRecord
+		if store.Get(bucketJettonMaster, key.String(), &record) {
+			if info, err := record.info(); err == nil {
+				entry = &jettonMasterEntry{info: info, metadataAt: now}
+			}
+		}
+	}
+
+	if entry == nil || now.Sub(entry.metadataAt) >= c.metadataTTL {
+		info, err := fetchJettonMasterInfo(api, masterAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		c.set(key, &jettonMasterEntry{info: info, metadataAt: now, supplyAt: now})
+		store.Set(bucketJettonMaster, key.String(), info.record(), c.metadataTTL)
+		return info, nil
+	}
+
+	data, err := jetton.NewJettonMasterClient(api, masterAddr).GetJettonData(context.Background())
+	if err != nil {
+		// keep serving the last known supply rather than failing the swap,
+		// and back off so every swap of the token doesn't retry in line
+		log.Debug().Err(err).Msgf("failed to refresh supply of %s", masterAddr.String())
+		retryAt := now.Add(-c.supplyTTL + supplyRetryDelay)
+		if supplyRetryDelay > c.supplyTTL {
+			retryAt = now
+		}
+		c.set(key, &jettonMasterEntry{info: entry.info, metadataAt: entry.metadataAt, supplyAt: retryAt})
+		return entry.info, nil
+	}
+
+	info := *entry.info
+	info.totalSupply = data.TotalSupply
+	info.mintable = data.Mintable
+	info.adminAddr = data.AdminAddr
+
+	c.set(key, &jettonMasterEntry{info: &info, metadataAt: entry.metadataAt, supplyAt: now})
+	return &info, nil
+}
+
+func (c *JettonMasterInfoCache) set(key addrKey, entry *jettonMasterEntry) {
+	tokenVerifier.Verify(entry.info)
+
+	c.mutex.Lock()
+	c.m[key] = entry
+	c.mutex.Unlock()
+}
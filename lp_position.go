@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/jetton"
+)
+
+// max concurrent get_wallet_data requests while scanning pools for a wallet
+var lpScanConcurrency = 8
+
+type LPPosition struct {
+	Wallet string `json:"wallet"`
+	Pool   string `json:"pool"`
+	Symbol string `json:"symbol"`
+
+	Balance     string  `json:"balance"`
+	TotalSupply string  `json:"total_supply"`
+	Share       float64 `json:"share"`
+
+	Token0Symbol string `json:"token0_symbol"`
+	Token1Symbol string `json:"token1_symbol"`
+	Token0Amount string `json:"token0_amount"`
+	Token1Amount string `json:"token1_amount"`
+
+	Token0Verification string `json:"token0_verification"`
+	Token1Verification string `json:"token1_verification"`
+
+	// nil if any of the pool token prices is unknown
+	ValueUSD *float64 `json:"value_usd"`
+
+	// relative to holding the amounts observed when the position was first
+	// seen, not the actual deposit, e.g. -0.02 is 2% loss
+	ImpermanentLoss float64   `json:"impermanent_loss"`
+	Baseline        string    `json:"baseline"`
+	FirstSeenAt     time.Time `json:"first_seen_at"`
+}
+
+// only baseline so far, the position as first queried through this service
+const lpBaselineFirstSeen = "first_seen"
+
+// underlying amounts per one LP unit at the time a position was first seen,
+// used as the hold baseline for impermanent loss. persisted in the store so
+// the baseline survives restarts
+type lpDeposit struct {
+	Token0PerLP *big.Float `json:"token0_per_lp"`
+	Token1PerLP *big.Float `json:"token1_per_lp"`
+	At          time.Time  `json:"at"`
+}
+
+// track LP positions of arbitrary wallets in pools known to price collector
+type LPTracker struct {
+	api ton.APIClientWrapped
+
+	mutex    sync.Mutex
+	deposits map[string]lpDeposit
+}
+
+func NewLPTracker(api ton.APIClientWrapped) *LPTracker {
+	return &LPTracker{
+		api:      api,
+		mutex:    sync.Mutex{},
+		deposits: make(map[string]lpDeposit),
+	}
+}
+
+// scan all known pools and return positions with non zero LP balance
+func (t *LPTracker) Positions(ctx context.Context, wallet *address.Address) ([]*LPPosition, error) {
+	pools := priceCollector.Pools()
+
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		positions = make([]*LPPosition, 0)
+		sem       = make(chan struct{}, lpScanConcurrency)
+	)
+
+	for _, pool := range pools {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(pool *PoolInfo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			position, err := t.position(ctx, wallet, pool)
+			if err != nil {
+				log.Debug().Err(err).Msgf("failed to get LP position of %s in %s", wallet.String(), pool.addr.String())
+				return
+			}
+
+			if position == nil {
+				return
+			}
+
+			mutex.Lock()
+			positions = append(positions, position)
+			mutex.Unlock()
+		}(pool)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return positions, nil
+}
+
+func (t *LPTracker) position(ctx context.Context, wallet *address.Address, pool *PoolInfo) (*LPPosition, error) {
+	// STON.fi pool is the LP jetton master itself
+	master := jetton.NewJettonMasterClient(t.api, pool.addr)
+	lpWallet, err := master.GetJettonWallet(ctx, wallet)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := lpWallet.GetBalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if balance.Sign() == 0 {
+		return nil, nil
+	}
+
+	data, err := master.GetJettonData(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.TotalSupply == nil || data.TotalSupply.Sign() == 0 {
+		return nil, errors.New("LP total supply is zero")
+	}
+	pool.lpTotalSupply = data.TotalSupply
+
+	if err := pool.UpdateReserve(t.api); err != nil {
+		return nil, err
+	}
+
+	amount0 := new(big.Int).Div(new(big.Int).Mul(pool.reserve0, balance), data.TotalSupply)
+	amount1 := new(big.Int).Div(new(big.Int).Mul(pool.reserve1, balance), data.TotalSupply)
+	share, _ := new(big.Float).Quo(new(big.Float).SetInt(balance), new(big.Float).SetInt(data.TotalSupply)).Float64()
+
+	position := &LPPosition{
+		Wallet:       wallet.String(),
+		Pool:         pool.addr.String(),
+		Symbol:       pool.symbol,
+		Balance:      balance.String(),
+		TotalSupply:  data.TotalSupply.String(),
+		Share:        share,
+		Token0Symbol: "unknown",
+		Token1Symbol: "unknown",
+		Token0Amount: amount0.String(),
+		Token1Amount: amount1.String(),
+
+		Token0Verification: pool.token0JettonMaster.Verification(),
+		Token1Verification: pool.token1JettonMaster.Verification(),
+	}
+
+	if pool.token0JettonMaster != nil && pool.token1JettonMaster != nil {
+		position.Token0Symbol = pool.token0JettonMaster.symbol
+		position.Token1Symbol = pool.token1JettonMaster.symbol
+
+		v0, ok0 := priceCollector.USDValue(pool.token0JettonMaster, amount0)
+		v1, ok1 := priceCollector.USDValue(pool.token1JettonMaster, amount1)
+		if ok0 && ok1 {
+			value := v0 + v1
+			position.ValueUSD = &value
+		}
+	}
+
+	deposit := t.firstDeposit(wallet, pool, balance, amount0, amount1)
+	position.Baseline = lpBaselineFirstSeen
+	position.FirstSeenAt = deposit.At
+	position.ImpermanentLoss = impermanentLoss(deposit, balance, amount0, amount1, pool.reserve0, pool.reserve1)
+
+	return position, nil
+}
+
+// remember the first observed deposit of wallet in pool, later observations
+// and restarts reuse it
+func (t *LPTracker) firstDeposit(wallet *address.Address, pool *PoolInfo, balance, amount0, amount1 *big.Int) lpDeposit {
+	key := wallet.String() + "/" + pool.addr.String()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if deposit, ok := t.deposits[key]; ok {
+		return deposit
+	}
+
+	var deposit lpDeposit
+	if store.Get(bucketLPBaseline, key, &deposit) && deposit.Token0PerLP != nil && deposit.Token1PerLP != nil {
+		t.deposits[key] = deposit
+		return deposit
+	}
+
+	lp := new(big.Float).SetInt(balance)
+	deposit = lpDeposit{
+		Token0PerLP: new(big.Float).Quo(new(big.Float).SetInt(amount0), lp),
+		Token1PerLP: new(big.Float).Quo(new(big.Float).SetInt(amount1), lp),
+		At:          time.Now(),
+	}
+	t.deposits[key] = deposit
+	store.Set(bucketLPBaseline, key, deposit, 0)
+
+	return deposit
+}
+
+// compare value of the LP position with holding the deposited amounts,
+// both valued in token1 at current pool price
+func impermanentLoss(deposit lpDeposit, balance, amount0, amount1, reserve0, reserve1 *big.Int) float64 {
+	if reserve0.Sign() == 0 {
+		return 0
+	}
+
+	price := new(big.Float).Quo(new(big.Float).SetInt(reserve1), new(big.Float).SetInt(reserve0))
+	lp := new(big.Float).SetInt(balance)
+
+	held := new(big.Float).Add(
+		new(big.Float).Mul(new(big.Float).Mul(deposit.Token0PerLP, lp), price),
+		new(big.Float).Mul(deposit.Token1PerLP, lp),
+	)
+	if held.Sign() == 0 {
+		return 0
+	}
+
+	current := new(big.Float).Add(
+		new(big.Float).Mul(new(big.Float).SetInt(amount0), price),
+		new(big.Float).SetInt(amount1),
+	)
+
+	ratio, _ := new(big.Float).Quo(current, held).Float64()
+	return ratio - 1
+}
+
+func handleLPPositions(rw http.ResponseWriter, req *http.Request) {
+	wallet, err := address.ParseAddr(req.URL.Query().Get("wallet"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	positions, err := lpTracker.Positions(req.Context(), wallet)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, positions)
+}
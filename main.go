@@ -7,7 +7,7 @@ import (
 	"flag"
 	"math/big"
 	"net/http"
-	"strconv"
+	"os"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -30,11 +30,42 @@ var (
 
 	port = flag.String("port", "8080", "port")
 	host = flag.String("host", "localhost", "host")
+
+	poolRefresh        = flag.Duration("pool-refresh", 5*time.Minute, "interval of pool parameter refresh")
+	metadataRefresh    = flag.Duration("metadata-refresh", 24*time.Hour, "refresh interval of jetton master name, symbol, decimals")
+	supplyRefresh      = flag.Duration("supply-refresh", time.Minute, "refresh interval of jetton master supply, mintable and admin")
+	ipfsGatewayList    = flag.String("ipfs-gateways", strings.Join(ipfsGateways, ","), "comma separated ipfs gateways for ipfs:// metadata")
+	tonGatewayList     = flag.String("ton-gateways", strings.Join(tonStorageGateways, ","), "comma separated TON Storage gateways for ton:// metadata")
+	metadataTimeout    = flag.Duration("metadata-timeout", 10*time.Second, "timeout of a single off-chain metadata request")
+	metadataMaxBody    = flag.Int64("metadata-max-body", 1<<20, "max off-chain metadata body size in bytes")
+	tonMaster          = flag.String("ton-master", tonMasterAddr.String(), "jetton master address of TON (pTON) used as price anchor")
+	stableAnchors      = flag.String("stable-anchors", defaultStableAnchors, "comma separated stablecoins symbol:master[:pool] whose TON pools price TON in usd, pool is looked up when omitted")
+	checkDepeg         = flag.Bool("depeg-check", depegCheck, "price stablecoins off the combined TON price by their pool instead of $1")
+	depegDeviation     = flag.Float64("depeg-threshold", depegThreshold, "deviation of a stablecoin TON price from the combined one, 0.02 is 2%, beyond it the stablecoin is off peg")
+	verifiedTokens     = flag.String("verified-tokens", "", "json file with verified jetton masters [{address, symbol, name}]")
+	supplyWatchlist    = flag.String("supply-watchlist", "", "comma separated jetton masters whose supply and admin are monitored")
+	supplyWatch        = flag.Duration("supply-watch", time.Minute, "interval of watchlist supply checks")
+	excludedWallets    = flag.String("excluded-wallets", "", "json file with burn and locked wallets excluded from circulating supply")
+	excludeAdmin       = flag.Bool("exclude-admin", true, "exclude jetton admin balance from circulating supply")
+	storePath          = flag.String("store", "dexstats.store.json", "path of on-disk metadata cache, empty to disable")
+	dataDir            = flag.String("data-dir", "dexstats.data", "directory of per-day trade, candle and price history segments, empty to disable")
+	walletCacheSize    = flag.Int("wallet-cache-size", 10000, "max jetton wallet to jetton master mappings kept in memory")
+	priceMaxAgeFlag    = flag.Duration("price-max-age", priceMaxAge, "age of pool data after which prices derived from it are stale and shown as N/A")
+	tradeRetentionFlag = flag.Duration("trade-retention", tradeRetention, "how long swaps are kept in the trade log to rebuild candles from")
+	priceOutlier       = flag.Float64("price-outlier", priceOutlierThreshold, "max deviation of a pool price from the weighted median, 0.1 is 10%, beyond it the pool is left out of the token price")
+	priceWindows       = flag.String("price-windows", defaultPriceWindows, "TWAP and VWAP windows, default for every token then per token overrides: 5m,1h;<jetton master>=1m,15m")
+	historyInterval    = flag.Duration("price-history-interval", priceHistoryInterval, "min time between recorded price snapshots of the price history")
+	historyRetention   = flag.Duration("price-history-retention", priceHistoryRetention, "how long recorded price snapshots are kept in memory and in the history log")
+	priceAlerts        = flag.String("price-alerts", "", "json file with price alert rules [{name, token, kind: cross|change, price, percent, window, cooldown, webhooks}]")
+	alertWebhookList   = flag.String("alert-webhooks", "", "comma separated urls every price alert is posted to")
+	alertCooldownFlag  = flag.Duration("alert-cooldown", alertCooldown, "min time between two alerts of the same rule, unless the rule sets its own")
+	depthReport        = flag.Duration("depth-report", 0, "interval of liquidity depth report, 0 to disable")
 )
 
 var (
 	opJettonNotify = uint64(0x7362d09c)
 	opStonfiSwap   = uint64(0x25938561)
+	opStonfiPayTo  = uint64(0xf93bb43f)
 )
 
 var (
@@ -44,6 +75,8 @@ var (
 
 var (
 	sse *SSEServer
+	// named json events: candles, price alerts, pool and supply changes
+	sseEvents *SSEServer
 )
 
 var swapProcessedCount atomic.Uint64
@@ -54,15 +87,65 @@ var (
 // stonfi dex address, transaction on this address will be watched
 var stonfiAddr *address.Address = address.MustParseAddr("EQB3ncyBUTjZUA5EnFKR5_EnOMI9V1tTEAAPaiU71gc4TiUt")
 
-// use this to cache any jetton master
-var jWalletMasterCache = NewJettonWalletJettonMasterAddrCache()
+// use this to cache any jetton master, sized from flag in main
+var jWalletMasterCache *JettonWalletJettonMasterAddrCache = nil
+
+// cache parsed jetton master info, refreshed from flags in main
+var jettonMasterCache = NewJettonMasterInfoCache()
+
+// shared off-chain metadata fetcher, configured from flags in main
+var metadataFetcher = NewMetadataFetcher(10*time.Second, 1<<20)
+
+// circulating supply, market cap and FDV per jetton
+var marketCapTracker *MarketCapTracker = nil
+
+// supply, mint and burn tracking of watchlist jettons
+var supplyMonitor *SupplyMonitor = nil
+
+// allowlist of known jetton masters, used to flag copycats
+var tokenVerifier = NewTokenVerifier()
 
 // cache all jetton master metadata
 var masterOffChainDataCache = NewJettonMasterOffChainDataCache()
 
+// on-disk copy of jetton metadata and wallet master mappings, nil if disabled
+var store *Store = nil
+
+// per-day segments of trades, candles and price history, nil if disabled
+var (
+	tradeLog    *SegmentLog = nil
+	candleLog   *SegmentLog = nil
+	historyLog  *SegmentLog = nil
+	dataDirLock *os.File    = nil
+)
+
 // use this to cache any pool info
 var priceCollector *PriceCollector = nil
 
+// track LP positions of wallets queried through http api
+var lpTracker *LPTracker = nil
+
+// swap volume and protocol fee history for yield estimation
+var feeTracker = NewFeeTracker()
+
+// OHLCV candles of every swap, per pool and per token
+var candleAggregator = NewCandleAggregator()
+
+// match swaps with the payouts of their pools
+var swapSettler = NewSwapSettler()
+
+// TWAP and VWAP per token over the windows of the price-windows flag
+var priceFeeds *PriceFeeds = nil
+
+// recorded price snapshots for price history queries
+var priceHistory = NewPriceHistory()
+
+// price alert rules, none unless loaded from the price-alerts file
+var alertEngine = NewAlertEngine(nil)
+
+// watch pool fee and LP jetton parameter changes
+var poolMonitor *PoolMonitor = nil
+
 func main() {
 	flag.Parse()
 
@@ -79,11 +162,52 @@ func main() {
 
 	log.Logger = zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
 
+	if flag.NArg() > 0 {
+		panicErr(runCommand(flag.Args()))
+		return
+	}
+
+	jWalletMasterCache = NewJettonWalletJettonMasterAddrCache(*walletCacheSize)
+	ipfsGateways = parseGateways(*ipfsGatewayList)
+	tonStorageGateways = parseGateways(*tonGatewayList)
+	metadataFetcher = NewMetadataFetcher(*metadataTimeout, *metadataMaxBody)
+	jettonMasterCache.metadataTTL = *metadataRefresh
+	jettonMasterCache.supplyTTL = *supplyRefresh
+	priceOutlierThreshold = *priceOutlier
+	priceMaxAge = *priceMaxAgeFlag
+	tradeRetention = *tradeRetentionFlag
+	priceHistoryInterval = *historyInterval
+	priceHistoryRetention = *historyRetention
+	alertCooldown = *alertCooldownFlag
+	alertWebhooks = parseWebhooks(*alertWebhookList)
+
+	if *dataDir != "" {
+		panicErr(openSegmentLogs(*dataDir))
+	}
+
+	if *storePath != "" {
+		var err error
+		store, err = OpenStore(*storePath)
+		panicErr(err)
+		panicErr(store.Lock())
+
+		loadStoreIntoCaches(store)
+		migrateLegacyBuckets(store)
+		go store.PeriodicallyFlush()
+	}
+
+	candleAggregator.Load(candleLog)
+	priceHistory.Load(historyLog)
+	go candleAggregator.PeriodicallyPersist()
+	for _, sl := range []*SegmentLog{tradeLog, candleLog, historyLog} {
+		if sl != nil {
+			go sl.PeriodicallyPrune()
+		}
+	}
+	go flushOnShutdown()
+
 	sse = NewServer()
-	go func() {
-		log.Info().Msgf("start sse server on %s:%s", *host, *port)
-		http.ListenAndServe(*host+":"+*port, sse)
-	}()
+	sseEvents = NewServer()
 
 	client := liteclient.NewConnectionPool()
 	cfg, err := liteclient.GetConfigFromUrl(context.Background(), "https://ton.org/global.config.json")
@@ -110,6 +234,54 @@ func main() {
 	}
 	log.Debug().Msgf("account state: %t", acc.IsActive)
 
+	tonMasterAddr, err = address.ParseAddr(*tonMaster)
+	panicErr(err)
+	anchors, err := parseStableAnchors(*stableAnchors)
+	panicErr(err)
+	depegCheck = *checkDepeg
+	depegThreshold = *depegDeviation
+
+	tokenVerifier.Add(verifiedToken{Address: tonMasterAddr.String(), Symbol: "pTON", Name: "Proxy TON"})
+	for _, sa := range anchors {
+		tokenVerifier.Add(verifiedToken{Address: sa.master.String(), Symbol: sa.symbol, Name: sa.symbol})
+	}
+	if *verifiedTokens != "" {
+		panicErr(tokenVerifier.LoadFile(*verifiedTokens))
+	}
+
+	priceCollector = NewPriceCollector(api, anchors)
+	go priceCollector.PeriodicallyGetTONUSDPool()
+
+	priceFeeds, err = NewPriceFeeds(*priceWindows)
+	panicErr(err)
+	go priceFeeds.PeriodicallySample()
+	go priceHistory.PeriodicallyRecord()
+
+	if *priceAlerts != "" {
+		rules, err := LoadAlertRules(*priceAlerts)
+		panicErr(err)
+		alertEngine = NewAlertEngine(rules)
+	}
+	go alertEngine.PeriodicallyEvaluate()
+
+	lpTracker = NewLPTracker(api)
+
+	marketCapTracker = NewMarketCapTracker(api, *excludeAdmin)
+	if *excludedWallets != "" {
+		panicErr(marketCapTracker.LoadExcludedWallets(*excludedWallets))
+	}
+
+	poolRefreshInterval = *poolRefresh
+	poolMonitor = NewPoolMonitor(api)
+	go poolMonitor.PeriodicallyRefreshPools()
+
+	go PeriodicallyReportDepth(*depthReport)
+
+	watchlist, err := parseWatchlist(*supplyWatchlist)
+	panicErr(err)
+	supplyMonitor = NewSupplyMonitor(api, watchlist, *supplyWatch)
+	go supplyMonitor.PeriodicallyWatchSupply()
+
 	// swap action outputs
 	swapActionsCh := make(chan *SwapAction)
 	go func() {
@@ -131,6 +303,8 @@ func main() {
 					log.Info().Msgf("%s", swapAction.String())
 				}
 
+				feeTracker.Record(swapAction)
+				swapSettler.Swap(swapAction)
 				sse.Notifier <- []byte(swapAction.CSV())
 			}
 		}
@@ -141,11 +315,15 @@ func main() {
 			time.Sleep(10 * time.Second)
 			log.Debug().Msgf("processed %d transactions, took %s, rate %.3f", swapProcessedCount.Load(), time.Since(beginAt),
 				float32(swapProcessedCount.Load())/float32(time.Since(beginAt).Seconds()))
+			log.Debug().Msgf("jetton wallet master cache: %s", jWalletMasterCache.Stats())
 		}
 	}()
 
-	priceCollector = NewPriceCollector(api)
-	go priceCollector.PeriodicallyGetTONUSDPool()
+	// handlers read the components above, serve only once all are built
+	go func() {
+		log.Info().Msgf("start sse server on %s:%s", *host, *port)
+		http.ListenAndServe(*host+":"+*port, newHTTPHandler())
+	}()
 
 	transactions := make(chan *tlb.Transaction)
 	lastProcessedLT := acc.LastTxLT
@@ -156,6 +334,20 @@ func main() {
 		log.Debug().Msgf("new transaction: %s", base64.StdEncoding.EncodeToString(tx.Hash))
 		inslice := tx.IO.In.AsInternal().Payload().BeginParse()
 
+		// payout of an executed swap, pool to router
+		if op, err := inslice.Copy().LoadUInt(32); err == nil && op == opStonfiPayTo {
+			payslice := inslice.Copy()
+			payslice.MustLoadUInt(32)
+			payout, err := parseSwapPayout(payslice, tx.IO.In.AsInternal().SrcAddr)
+			if err != nil {
+				log.Debug().Err(err).Msgf("failed to parse pay_to")
+				continue
+			}
+
+			swapSettler.Payout(payout)
+			continue
+		}
+
 		if tx.IO.Out == nil {
 			log.Debug().Msgf("transaction out is nil")
 			continue
@@ -299,12 +491,14 @@ func buildSwapAction(api ton.APIClientWrapped,
 		return nil, err
 	}
 	log.Debug().Msgf("outQueryId: %X", outQueryId)
+	swapAction.queryID = outQueryId
 
 	toAddress, err = out.LoadAddr()
 	if err != nil {
 		return nil, err
 	}
 	log.Debug().Msgf("2 toAddress: %s", toAddress.String())
+	swapAction.receiver = toAddress
 
 	senderAddress, err := out.LoadAddr()
 	if err != nil {
@@ -342,6 +536,7 @@ func buildSwapAction(api ton.APIClientWrapped,
 	if err != nil {
 		return nil, errors.New("failed to get LP pool info")
 	}
+	poolMonitor.Observe(swapAction.pool)
 
 	if info, err := jettonMasterInfoByJettonWallet(api, swapAction.pool.token0Address); err != nil {
 		log.Debug().Err(err).Msg("failed to get jetton master 0")
@@ -382,6 +577,8 @@ func populateLPPoolInfo(api ton.APIClientWrapped, poolAddr *address.Address, poo
 
 	reserve1 := res.MustInt(1)
 	pool.reserve1 = reserve1
+	pool.block = b.SeqNo
+	pool.updatedAt = time.Now()
 
 	token0AddrSlice, err := res.Slice(2)
 	if err != nil {
@@ -447,8 +644,14 @@ func jettonMasterInfoByJettonWallet(api ton.APIClientWrapped,
 		}
 
 		jWalletMasterCache.Set(jettonWallet, jettonMasterAddr)
+		store.Set(bucketWalletMaster, keyOf(jettonWallet).String(), jettonMasterAddr.String(), walletMasterTTL)
 	}
 
+	return jettonMasterCache.Get(api, jettonMasterAddr)
+}
+
+// fetch jetton data of master and parse its content
+func fetchJettonMasterInfo(api ton.APIClientWrapped, jettonMasterAddr *address.Address) (*JettonMasterInfo, error) {
 	jettonMaster := new(JettonMasterInfo)
 	jettonMaster.addr = jettonMasterAddr
 
@@ -462,28 +665,28 @@ func jettonMasterInfoByJettonWallet(api ton.APIClientWrapped,
 	jettonMaster.totalSupply = data.TotalSupply
 	jettonMaster.mintable = data.Mintable
 
-	switch data.Content.(type) {
+	switch content := data.Content.(type) {
 	case *nft.ContentOffchain:
-		content := data.Content.(*nft.ContentOffchain)
 		jettonMaster.offChainURI = content.URI
 		err := jettonMaster.FetchJettonMasterConfigFromURL()
 		if err != nil {
-			log.Error().Err(err).Msgf("failed to fetch lp info from url")
+			log.Error().Err(err).Msgf("failed to fetch jetton info from url")
+			jettonMaster.applyMetadata(tep64Metadata{})
 		}
+
 	case *nft.ContentOnchain:
-		payload, _ := data.Content.(*nft.ContentOnchain)
-		jettonMaster.name = payload.Name
-		jettonMaster.description = payload.Description
-		jettonMaster.image = payload.Image
-		jettonMaster.symbol = payload.GetAttribute("symbol")
-		jettonMaster.decimals, _ = strconv.Atoi(payload.GetAttribute("decimals"))
+		jettonMaster.applyMetadata(onchainMetadata(content))
 
 	case *nft.ContentSemichain:
-		payload, _ := data.Content.(*nft.ContentSemichain)
-		jettonMaster.name = payload.Name
-		jettonMaster.description = payload.Description
-		jettonMaster.image = payload.Image
-		jettonMaster.decimals, _ = strconv.Atoi(payload.GetAttribute("decimals"))
+		// on-chain fields override the off-chain ones found at uri
+		onchain := onchainMetadata(&content.ContentOnchain)
+		jettonMaster.offChainURI = content.URI
+
+		offchain, err := fetchOffChainMetadata(content.URI)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to fetch semichain jetton info from url")
+		}
+		jettonMaster.applyMetadata(onchain.merge(offchain))
 
 	default:
 		return nil, errors.New("unsupported content type")
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/jetton"
+)
+
+var (
+	// jettons sent here are gone for good
+	zeroAddr = address.MustParseAddr("EQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAM9c")
+
+	circulatingSupplyTTL = time.Minute * 5
+)
+
+// excluded wallets file
+//
+//	{
+//	  "burn": ["<owner>", ...],                  // excluded for every jetton
+//	  "tokens": {"<jetton master>": ["<owner>"]}  // locked, team, treasury...
+//	}
+type excludedWalletsConfig struct {
+	Burn   []string            `json:"burn"`
+	Tokens map[string][]string `json:"tokens"`
+}
+
+type ExcludedBalance struct {
+	Owner   string `json:"owner"`
+	Reason  string `json:"reason"`
+	Balance string `json:"balance"`
+}
+
+type TokenMarket struct {
+	Master       string `json:"master"`
+	Symbol       string `json:"symbol"`
+	Decimals     int    `json:"decimals"`
+	Verification string `json:"verification"`
+
+	TotalSupply       string            `json:"total_supply"`
+	CirculatingSupply string            `json:"circulating_supply"`
+	Excluded          []ExcludedBalance `json:"excluded"`
+
+	// nil when token price is unknown
+	MarketCapUSD *float64 `json:"market_cap_usd"`
+	FDVUSD       *float64 `json:"fdv_usd"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type circulatingEntry struct {
+	circulating *big.Int
+	excluded    []ExcludedBalance
+	at          time.Time
+	refreshing  bool
+}
+
+// circulating supply per jetton, total supply minus burn, locked and admin
+// wallets. balances are refreshed in background so swap outputs never wait
+type MarketCapTracker struct {
+	api          ton.APIClientWrapped
+	excludeAdmin bool
+
+	mutex   sync.Mutex
+	burn    []*address.Address
+	locked  map[addrKey][]*address.Address
+	entries map[addrKey]*circulatingEntry
+}
+
+func NewMarketCapTracker(api ton.APIClientWrapped, excludeAdmin bool) *MarketCapTracker {
+	return &MarketCapTracker{
+		api:          api,
+		excludeAdmin: excludeAdmin,
+		mutex:        sync.Mutex{},
+		burn:         []*address.Address{zeroAddr},
+		locked:       make(map[addrKey][]*address.Address),
+		entries:      make(map[addrKey]*circulatingEntry),
+	}
+}
+
+func (mt *MarketCapTracker) LoadExcludedWallets(path string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var cfg excludedWalletsConfig
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return err
+	}
+
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	for _, owner := range cfg.Burn {
+		addr, err := address.ParseAddr(owner)
+		if err != nil {
+			return err
+		}
+		mt.burn = append(mt.burn, addr)
+	}
+
+	for master, owners := range cfg.Tokens {
+		masterAddr, err := address.ParseAddr(master)
+		if err != nil {
+			return err
+		}
+
+		for _, owner := range owners {
+			addr, err := address.ParseAddr(owner)
+			if err != nil {
+				return err
+			}
+			mt.locked[keyOf(masterAddr)] = append(mt.locked[keyOf(masterAddr)], addr)
+		}
+	}
+
+	return nil
+}
+
+// circulating supply of master, last known value while a refresh runs in
+// background. nil until the first refresh finished
+func (mt *MarketCapTracker) Circulating(info *JettonMasterInfo) (*big.Int, []ExcludedBalance) {
+	key := keyOf(info.addr)
+
+	mt.mutex.Lock()
+	entry := mt.entries[key]
+	if entry == nil {
+		entry = new(circulatingEntry)
+		mt.entries[key] = entry
+	}
+
+	stale := time.Since(entry.at) > circulatingSupplyTTL
+	if stale && !entry.refreshing {
+		entry.refreshing = true
+		go mt.refresh(info)
+	}
+	circulating, excluded := entry.circulating, entry.excluded
+	mt.mutex.Unlock()
+
+	return circulating, excluded
+}
+
+func (mt *MarketCapTracker) refresh(info *JettonMasterInfo) {
+	key := keyOf(info.addr)
+
+	mt.mutex.Lock()
+	owners := make(map[addrKey]ExcludedBalance)
+	order := make([]*address.Address, 0)
+	add := func(owner *address.Address, reason string) {
+		if _, ok := owners[keyOf(owner)]; ok {
+			return
+		}
+		owners[keyOf(owner)] = ExcludedBalance{Owner: owner.String(), Reason: reason}
+		order = append(order, owner)
+	}
+
+	for _, owner := range mt.burn {
+		add(owner, "burn")
+	}
+	for _, owner := range mt.locked[key] {
+		add(owner, "locked")
+	}
+	if mt.excludeAdmin && info.adminAddr != nil {
+		add(info.adminAddr, "admin")
+	}
+	mt.mutex.Unlock()
+
+	circulating := new(big.Int)
+	if info.totalSupply != nil {
+		circulating.Set(info.totalSupply)
+	}
+	excluded := make([]ExcludedBalance, 0, len(order))
+	master := jetton.NewJettonMasterClient(mt.api, info.addr)
+
+	ok := true
+	for _, owner := range order {
+		balance, err := mt.balanceOf(master, owner)
+		if err != nil {
+			log.Debug().Err(err).Msgf("failed to get %s balance of %s", info.symbol, owner.String())
+			ok = false
+			break
+		}
+
+		eb := owners[keyOf(owner)]
+		eb.Balance = balance.String()
+		excluded = append(excluded, eb)
+		circulating.Sub(circulating, balance)
+	}
+
+	if circulating.Sign() < 0 {
+		circulating.SetInt64(0)
+	}
+
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	entry := mt.entries[key]
+	entry.refreshing = false
+	if ok {
+		entry.circulating = circulating
+		entry.excluded = excluded
+		entry.at = time.Now()
+	}
+}
+
+func (mt *MarketCapTracker) balanceOf(master *jetton.Client, owner *address.Address) (*big.Int, error) {
+	wallet, err := master.GetJettonWallet(context.Background(), owner)
+	if err != nil {
+		return nil, err
+	}
+
+	return wallet.GetBalance(context.Background())
+}
+
+// market cap over circulating supply and fully diluted valuation over total
+// supply, both in usd and scaled by token decimals
+func (mt *MarketCapTracker) Market(info *JettonMasterInfo) *TokenMarket {
+	tm := &TokenMarket{
+		Master:       info.addr.String(),
+		Symbol:       info.symbol,
+		Decimals:     info.decimals,
+		Verification: info.Verification(),
+		TotalSupply:  "0",
+		Excluded:     make([]ExcludedBalance, 0),
+	}
+
+	if info.totalSupply == nil {
+		return tm
+	}
+	tm.TotalSupply = info.totalSupply.String()
+
+	if fdv, ok := priceCollector.USDValue(info, info.totalSupply); ok {
+		tm.FDVUSD = &fdv
+	}
+
+	circulating, excluded := mt.Circulating(info)
+	if circulating == nil {
+		return tm
+	}
+
+	tm.CirculatingSupply = circulating.String()
+	tm.Excluded = excluded
+	if mcap, ok := priceCollector.USDValue(info, circulating); ok {
+		tm.MarketCapUSD = &mcap
+	}
+
+	mt.mutex.Lock()
+	tm.UpdatedAt = mt.entries[keyOf(info.addr)].at
+	mt.mutex.Unlock()
+
+	return tm
+}
+
+func usdString(v *float64) string {
+	if v == nil {
+		return "N/A"
+	}
+
+	return strconv.FormatFloat(*v, 'f', 2, 64)
+}
+
+func handleTokenMarket(rw http.ResponseWriter, req *http.Request) {
+	master, err := address.ParseAddr(req.URL.Query().Get("token"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	info, err := jettonMasterCache.Get(marketCapTracker.api, master)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, marketCapTracker.Market(info))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// gateways tried in order for ipfs:// and ton:// (TON Storage) metadata URIs,
+// overridden by flags in main
+var (
+	ipfsGateways = []string{
+		"https://ipfs.io/ipfs/",
+		"https://cloudflare-ipfs.com/ipfs/",
+		"https://gateway.pinata.cloud/ipfs/",
+	}
+
+	tonStorageGateways = []string{
+		"https://tonbyte.com/gateway/",
+	}
+)
+
+// comma separated gateway list from flag, each ending with a slash
+func parseGateways(s string) []string {
+	gateways := make([]string, 0)
+	for _, gw := range strings.Split(s, ",") {
+		gw = strings.TrimSpace(gw)
+		if gw == "" {
+			continue
+		}
+
+		if !strings.HasSuffix(gw, "/") {
+			gw += "/"
+		}
+		gateways = append(gateways, gw)
+	}
+
+	return gateways
+}
+
+// http(s) URLs to try for a metadata URI, in order
+func resolveMetadataURI(uri string) ([]string, error) {
+	uri = strings.TrimSpace(uri)
+	lower := strings.ToLower(uri)
+
+	var (
+		path     string
+		gateways []string
+	)
+
+	switch {
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"):
+		return []string{uri}, nil
+	case strings.HasPrefix(lower, "ipfs://"):
+		// both ipfs://<cid>/path and ipfs://ipfs/<cid>/path are in the wild
+		path = strings.TrimPrefix(uri[len("ipfs://"):], "ipfs/")
+		gateways = ipfsGateways
+	case strings.HasPrefix(lower, "ton://"):
+		path = uri[len("ton://"):]
+		gateways = tonStorageGateways
+	case strings.HasPrefix(lower, "tonstorage://"):
+		path = uri[len("tonstorage://"):]
+		gateways = tonStorageGateways
+	default:
+		return nil, fmt.Errorf("unsupported metadata uri %s", uri)
+	}
+
+	if path == "" || len(gateways) == 0 {
+		return nil, fmt.Errorf("no gateway for metadata uri %s", uri)
+	}
+
+	urls := make([]string, 0, len(gateways))
+	for _, gw := range gateways {
+		urls = append(urls, gw+path)
+	}
+
+	return urls, nil
+}
+
+var (
+	errMetadataTooLarge = errors.New("metadata body too large")
+	errHostCircuitOpen  = errors.New("metadata host circuit open")
+)
+
+// error worth retrying, i.e. network errors, 5xx and 429
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+// per host circuit breaker, opens after consecutive failures and lets one
+// request through once cooldown passed
+type hostBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+type metadataFailure struct {
+	err error
+	at  time.Time
+}
+
+// fetch off-chain metadata with timeout, body size limit, retry with backoff,
+// per host circuit breaker and negative caching of failed URIs
+type MetadataFetcher struct {
+	client  *http.Client
+	maxBody int64
+	retries int
+	backoff time.Duration
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	negativeTTL      time.Duration
+
+	mutex    sync.Mutex
+	breakers map[string]*hostBreaker
+	failures map[string]metadataFailure
+}
+
+func NewMetadataFetcher(timeout time.Duration, maxBody int64) *MetadataFetcher {
+	return &MetadataFetcher{
+		client:           &http.Client{Timeout: timeout},
+		maxBody:          maxBody,
+		retries:          2,
+		backoff:          time.Millisecond * 300,
+		breakerThreshold: 5,
+		breakerCooldown:  time.Minute,
+		negativeTTL:      time.Minute * 10,
+		mutex:            sync.Mutex{},
+		breakers:         make(map[string]*hostBreaker),
+		failures:         make(map[string]metadataFailure),
+	}
+}
+
+// fetch metadata body of uri, falling back across gateways
+func (f *MetadataFetcher) Fetch(uri string) ([]byte, error) {
+	f.mutex.Lock()
+	failure, ok := f.failures[uri]
+	f.mutex.Unlock()
+	if ok && time.Since(failure.at) < f.negativeTTL {
+		return nil, failure.err
+	}
+
+	urls, err := resolveMetadataURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, u := range urls {
+		now := time.Now()
+		body, err := f.fetchURL(u)
+		if err != nil {
+			log.Debug().Err(err).Msgf("failed to fetch metadata from %s", u)
+			lastErr = err
+			continue
+		}
+
+		log.Debug().Msgf("fetching metadata from %s done take %d ms", u, time.Since(now).Milliseconds())
+
+		f.mutex.Lock()
+		delete(f.failures, uri)
+		f.mutex.Unlock()
+
+		return body, nil
+	}
+
+	f.mutex.Lock()
+	f.failures[uri] = metadataFailure{err: lastErr, at: time.Now()}
+	f.mutex.Unlock()
+
+	return nil, lastErr
+}
+
+func (f *MetadataFetcher) fetchURL(u string) ([]byte, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	host := parsed.Host
+
+	var lastErr error
+	for attempt := 0; attempt <= f.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(f.backoff << (attempt - 1))
+		}
+
+		if !f.allow(host) {
+			return nil, errHostCircuitOpen
+		}
+
+		body, err := f.get(u)
+		f.record(host, err)
+		if err == nil {
+			return body, nil
+		}
+
+		lastErr = err
+		if _, ok := err.(retryableError); !ok {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+func (f *MetadataFetcher) get(u string) ([]byte, error) {
+	resp, err := f.client.Get(u)
+	if err != nil {
+		return nil, retryableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s returned %s", u, resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, retryableError{err}
+		}
+		return nil, err
+	}
+
+	if resp.ContentLength > f.maxBody {
+		return nil, errMetadataTooLarge
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxBody+1))
+	if err != nil {
+		return nil, retryableError{err}
+	}
+
+	if int64(len(body)) > f.maxBody {
+		return nil, errMetadataTooLarge
+	}
+
+	return body, nil
+}
+
+func (f *MetadataFetcher) allow(host string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	b := f.breakers[host]
+	if b == nil || b.failures < f.breakerThreshold {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+
+	// half open, let this one through and hold the rest for another cooldown
+	b.openUntil = now.Add(f.breakerCooldown)
+	return true
+}
+
+// only failures of the host itself count, a 404 for one file does not
+func (f *MetadataFetcher) record(host string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	b := f.breakers[host]
+	if b == nil {
+		b = new(hostBreaker)
+		f.breakers[host] = b
+	}
+
+	if _, ok := err.(retryableError); !ok {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures == f.breakerThreshold {
+		log.Warn().Msgf("metadata host %s failed %d times, pausing requests for %s", host, b.failures, f.breakerCooldown)
+		b.openUntil = time.Now().Add(f.breakerCooldown)
+	}
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
-	"net/http"
 	"strings"
 	"time"
 
@@ -14,6 +13,11 @@ import (
 	"github.com/xssnick/tonutils-go/ton"
 )
 
+// STON.fi pool fees (lpFee, protocolFee, refFee) are in 1/feeDivider units
+const feeDivider = 10000
+
+var errPoolNotFound = errors.New("pool not found")
+
 type PoolInfo struct {
 	addr *address.Address
 
@@ -25,6 +29,9 @@ type PoolInfo struct {
 
 	reserve0 *big.Int
 	reserve1 *big.Int
+	// masterchain seqno and time reserves were read at
+	block     uint32
+	updatedAt time.Time
 
 	lpFee       int64
 	protocolFee int64
@@ -92,34 +99,21 @@ func (pi *PoolInfo) String() string {
 
 func (pi *PoolInfo) FetchLpJettonMasterConfigFromURL() error {
 	log.Debug().Msgf("fetching lp jetton master config from %s", pi.lpOffchainURI)
-	now := time.Now()
-	resp, err := http.Get(pi.lpOffchainURI)
+	body, err := metadataFetcher.Fetch(pi.lpOffchainURI)
 	if err != nil {
 		return err
 	}
 
-	log.Debug().Msgf("fetching lp info from %s done takes %d ms", pi.lpOffchainURI, time.Since(now).Milliseconds())
-
-	defer resp.Body.Close()
-	type Content struct {
-		Symbol      string `json:"symbol"`
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Decimals    int    `json:"decimals"`
-		Image       string `json:"image"`
-	}
-
-	var content Content
-	err = json.NewDecoder(resp.Body).Decode(&content)
+	m, err := offchainMetadata(body)
 	if err != nil {
 		return err
 	}
 
-	pi.symbol = content.Symbol
-	pi.name = content.Name
-	pi.description = content.Description
-	pi.decimals = content.Decimals
-	pi.image = content.Image
+	pi.symbol = m.Symbol
+	pi.name = m.Name
+	pi.description = m.Description
+	pi.decimals = m.decimals()
+	pi.image = m.Image
 
 	return nil
 }
@@ -143,6 +137,47 @@ func (pi *PoolInfo) GetToken1Symbol() string {
 	return pi.symbol[startIndex:endIndex]
 }
 
+// index (0 or 1) of a pool token given as index, symbol, jetton master or pool jetton wallet address.
+// symbols are only matched within the pool, never used to identify a token globally
+func (pi *PoolInfo) TokenIndex(token string) (int, error) {
+	if token == "0" || token == "1" {
+		return int(token[0] - '0'), nil
+	}
+
+	masters := []*JettonMasterInfo{pi.token0JettonMaster, pi.token1JettonMaster}
+	wallets := []*address.Address{pi.token0Address, pi.token1Address}
+
+	addr, _ := address.ParseAddr(token)
+	for i := range masters {
+		if masters[i] != nil && (masters[i].symbol == token || sameAddr(masters[i].addr, addr)) {
+			return i, nil
+		}
+
+		if sameAddr(wallets[i], addr) {
+			return i, nil
+		}
+	}
+
+	return 0, errUnknownPoolToken
+}
+
+func (pi *PoolInfo) tokenMaster(i int) *JettonMasterInfo {
+	if i == 1 {
+		return pi.token1JettonMaster
+	}
+
+	return pi.token0JettonMaster
+}
+
+func (pi *PoolInfo) tokenSymbol(i int) string {
+	master := pi.tokenMaster(i)
+	if master == nil {
+		return "unknown"
+	}
+
+	return master.symbol
+}
+
 func (pi *PoolInfo) UpdateReserve(api ton.APIClientWrapped) error {
 	log.Debug().Msgf("update reserve0 and reserve1: %s", pi.addr.String())
 	now := time.Now()
@@ -168,6 +203,8 @@ func (pi *PoolInfo) UpdateReserve(api ton.APIClientWrapped) error {
 		return err
 	}
 	pi.reserve1 = reserve1
+	pi.block = b.SeqNo
+	pi.updatedAt = time.Now()
 
 	log.Debug().Msgf("new reserve0: %s, reserve1: %s", pi.reserve0.String(), pi.reserve1.String())
 
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/jetton"
+)
+
+var (
+	poolRefreshInterval   = time.Minute * 5
+	maxPoolChangeHistory  = 256
+	poolChangeEventType   = "pool_param_change"
+	monitoredPoolParamSet = []string{"lpFee", "protocolFee", "refFee", "lpAdminAddr", "lpMintable"}
+)
+
+// pool parameters we watch for changes
+type poolParams struct {
+	lpFee       int64
+	protocolFee int64
+	refFee      int64
+	lpAdminAddr string
+	lpMintable  bool
+
+	// LP jetton data was fetched, otherwise lpAdminAddr and lpMintable are meaningless
+	lpKnown bool
+}
+
+func poolParamsOf(pi *PoolInfo) poolParams {
+	params := poolParams{
+		lpFee:       pi.lpFee,
+		protocolFee: pi.protocolFee,
+		refFee:      pi.refFee,
+		lpMintable:  pi.lpMintable,
+		lpKnown:     pi.lpTotalSupply != nil,
+	}
+
+	if pi.lpAdminAddr != nil {
+		params.lpAdminAddr = pi.lpAdminAddr.String()
+	}
+
+	return params
+}
+
+func (p poolParams) values() map[string]string {
+	return map[string]string{
+		"lpFee":       fmt.Sprint(p.lpFee),
+		"protocolFee": fmt.Sprint(p.protocolFee),
+		"refFee":      fmt.Sprint(p.refFee),
+		"lpAdminAddr": p.lpAdminAddr,
+		"lpMintable":  fmt.Sprint(p.lpMintable),
+	}
+}
+
+type PoolChangeEvent struct {
+	Type   string    `json:"type"`
+	Pool   string    `json:"pool"`
+	Symbol string    `json:"symbol"`
+	Param  string    `json:"param"`
+	Old    string    `json:"old"`
+	New    string    `json:"new"`
+	At     time.Time `json:"at"`
+}
+
+// diff successive pool parameter snapshots and keep per pool change history
+type PoolMonitor struct {
+	api ton.APIClientWrapped
+
+	mutex sync.Mutex
+	last  map[string]poolParams
+	// block the last snapshot of each pool was read at
+	lastBlock map[string]uint32
+	history   map[string][]PoolChangeEvent
+}
+
+func NewPoolMonitor(api ton.APIClientWrapped) *PoolMonitor {
+	return &PoolMonitor{
+		api:       api,
+		mutex:     sync.Mutex{},
+		last:      make(map[string]poolParams),
+		lastBlock: make(map[string]uint32),
+		history:   make(map[string][]PoolChangeEvent),
+	}
+}
+
+// compare pool with the previous snapshot, first observation only records it.
+// swaps and refreshes both observe, a copy read at an older block than the
+// last snapshot arrived late and is ignored
+func (pm *PoolMonitor) Observe(pi *PoolInfo) []PoolChangeEvent {
+	key := pi.addr.String()
+	current := poolParamsOf(pi)
+
+	pm.mutex.Lock()
+	previous, seen := pm.last[key]
+	if seen && pi.block < pm.lastBlock[key] {
+		pm.mutex.Unlock()
+		return nil
+	}
+	// a copy without LP jetton data says nothing about it
+	if seen && previous.lpKnown && !current.lpKnown {
+		current.lpAdminAddr, current.lpMintable, current.lpKnown = previous.lpAdminAddr, previous.lpMintable, true
+	}
+	pm.last[key] = current
+	pm.lastBlock[key] = pi.block
+	if !seen || previous == current {
+		pm.mutex.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	oldValues, newValues := previous.values(), current.values()
+	events := make([]PoolChangeEvent, 0)
+	for _, param := range monitoredPoolParamSet {
+		if oldValues[param] == newValues[param] {
+			continue
+		}
+
+		if !previous.lpKnown && (param == "lpAdminAddr" || param == "lpMintable") {
+			continue
+		}
+
+		events = append(events, PoolChangeEvent{
+			Type:   poolChangeEventType,
+			Pool:   key,
+			Symbol: pi.symbol,
+			Param:  param,
+			Old:    oldValues[param],
+			New:    newValues[param],
+			At:     now,
+		})
+	}
+
+	history := append(pm.history[key], events...)
+	if len(history) > maxPoolChangeHistory {
+		history = history[len(history)-maxPoolChangeHistory:]
+	}
+	pm.history[key] = history
+	pm.mutex.Unlock()
+
+	for _, event := range events {
+		log.Warn().Msgf("pool %s (%s) %s changed from %s to %s", event.Pool, event.Symbol, event.Param, event.Old, event.New)
+
+		sseEvents.Publish(poolChangeEventType, event)
+	}
+
+	return events
+}
+
+func (pm *PoolMonitor) History(pool string) []PoolChangeEvent {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return append([]PoolChangeEvent(nil), pm.history[pool]...)
+}
+
+// refresh pool data and LP jetton data of all known pools, diff them and
+// hand the refreshed copies back to the price collector
+func (pm *PoolMonitor) PeriodicallyRefreshPools() {
+	ticker := time.NewTicker(poolRefreshInterval)
+	for range ticker.C {
+		for _, pi := range priceCollector.Pools() {
+			if err := pm.refresh(pi); err != nil {
+				log.Debug().Err(err).Msgf("failed to refresh pool %s", pi.addr.String())
+				continue
+			}
+
+			pm.Observe(pi)
+			priceCollector.SetItem(pi.addr.String(), pi)
+		}
+	}
+}
+
+func (pm *PoolMonitor) refresh(pi *PoolInfo) error {
+	if err := populateLPPoolInfo(pm.api, pi.addr, pi); err != nil {
+		return err
+	}
+
+	data, err := jetton.NewJettonMasterClient(pm.api, pi.addr).GetJettonData(context.Background())
+	if err != nil {
+		return err
+	}
+
+	pi.lpAdminAddr = data.AdminAddr
+	pi.lpMintable = data.Mintable
+	pi.lpTotalSupply = data.TotalSupply
+
+	return nil
+}
+
+func handlePoolChanges(rw http.ResponseWriter, req *http.Request) {
+	poolAddr, err := address.ParseAddr(req.URL.Query().Get("pool"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, poolMonitor.History(poolAddr.String()))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// a swap's copy of a pool read before the last refresh must neither report
+// a change nor revert one, nor replace the refreshed copy
+func TestPoolMonitorIgnoresStaleCopies(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	defer func(s *SSEServer, pic *PriceCollector) { sseEvents, priceCollector = s, pic }(sseEvents, priceCollector)
+	sseEvents = NewServer()
+	priceCollector = NewPriceCollector(nil, nil)
+
+	ton, token := testMaster(1, "pTON", 9), testMaster(10, "T", 9)
+	stale := testPool(100, ton, token, 1_000_000, 2_000_000)
+	stale.block, stale.lpFee = 10, 20
+
+	refreshed := *stale
+	refreshed.block, refreshed.lpFee = 12, 25
+
+	pm := NewPoolMonitor(nil)
+	pm.Observe(stale)
+	if events := pm.Observe(&refreshed); len(events) != 1 || events[0].New != "25" {
+		t.Fatalf("refresh events %+v, want lpFee 20 -> 25", events)
+	}
+	priceCollector.SetItem(refreshed.addr.String(), &refreshed)
+
+	// the swap path observes and stores its older copy after the refresh
+	if events := pm.Observe(stale); len(events) != 0 {
+		t.Errorf("stale copy produced events %+v", events)
+	}
+	priceCollector.SetItem(stale.addr.String(), stale)
+
+	if pi := priceCollector.GetItem(stale.addr.String()); pi == nil || pi.lpFee != 25 || pi.block != 12 {
+		t.Errorf("stored pool %+v, want the refreshed one", pi)
+	}
+	if history := pm.History(stale.addr.String()); len(history) != 1 {
+		t.Errorf("history %+v, want the one refresh change", history)
+	}
+}
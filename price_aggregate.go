@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sort"
+)
+
+// pool prices further than this from the weighted median are dropped from
+// the aggregate, 0.1 is 10%. overridden by flag in main
+var priceOutlierThreshold = 0.1
+
+// price of a token implied by a single pool and the price of its other side
+type PoolPrice struct {
+	Pool         string  `json:"pool"`
+	Quote        string  `json:"quote"`
+	PriceUSD     float64 `json:"price_usd"`
+	LiquidityUSD float64 `json:"liquidity_usd"`
+	Outlier      bool    `json:"outlier"`
+	Block        uint32  `json:"block"`
+
+	value  Decimal
+	source priceSource
+}
+
+// replace the path price of every non anchor token by the liquidity weighted
+// mean over all pools pairing it with a priced token, outliers excluded
+func aggregatePrices(pools []*PoolInfo, prices map[addrKey]Currency, isAnchor map[addrKey]bool) {
+	quotes := make(map[addrKey][]PoolPrice)
+	for _, pi := range pools {
+		if pi.token0JettonMaster == nil || pi.token1JettonMaster == nil {
+			continue
+		}
+		if pi.reserve0 == nil || pi.reserve1 == nil || pi.reserve0.Sign() <= 0 || pi.reserve1.Sign() <= 0 {
+			continue
+		}
+
+		for to := 0; to < 2; to++ {
+			from := 1 - to
+			toKey, fromKey := keyOf(pi.tokenMaster(to).addr), keyOf(pi.tokenMaster(from).addr)
+			quote, ok := prices[fromKey]
+			if !ok || isAnchor[toKey] || quotesThrough(quote.path, pi, pi.tokenMaster(to).addr.String()) {
+				continue
+			}
+
+			var value Decimal
+			reserveFrom := pi.reserve0
+			if to == 1 {
+				value = calculatePriceWithReserveP1(pi.reserve0, pi.reserve1, pi.token0JettonMaster.decimals, pi.token1JettonMaster.decimals, quote.value)
+			} else {
+				value = calculatePriceWithReserveP0(pi.reserve0, pi.reserve1, pi.token0JettonMaster.decimals, pi.token1JettonMaster.decimals, quote.value)
+				reserveFrom = pi.reserve1
+			}
+
+			source := quote.source.older(poolSource(pi))
+			quotes[toKey] = append(quotes[toKey], PoolPrice{
+				Pool:         pi.addr.String(),
+				Quote:        pi.tokenMaster(from).addr.String(),
+				PriceUSD:     value.Float64(),
+				LiquidityUSD: sideLiquidityUSD(reserveFrom, pi.tokenMaster(from).decimals, quote.value),
+				Block:        source.block,
+				value:        value,
+				source:       source,
+			})
+		}
+	}
+
+	for key, qs := range quotes {
+		c, ok := prices[key]
+		if !ok {
+			continue
+		}
+
+		value, spread, ok := aggregatePoolPrices(qs)
+		if ok {
+			c.value = value
+			c.source = quotesSource(qs)
+		}
+		c.pools = qs
+		c.spread = spread
+		prices[key] = c
+	}
+}
+
+// whether a quote priced along path comes back through pool or token, its
+// price then already derives from the price it would quote
+func quotesThrough(path *PricePath, pool *PoolInfo, token string) bool {
+	if path == nil {
+		return false
+	}
+
+	for _, p := range path.Pools {
+		if p == pool.addr.String() {
+			return true
+		}
+	}
+	for _, t := range path.Tokens {
+		if t == token {
+			return true
+		}
+	}
+
+	return false
+}
+
+// liquidity weighted mean of pool prices within priceOutlierThreshold of the
+// weighted median, and spread (max - min) / median over all pools. marks
+// outliers in place, false when no pool is left
+func aggregatePoolPrices(qs []PoolPrice) (Decimal, float64, bool) {
+	sort.Slice(qs, func(i, j int) bool { return qs[i].value.Cmp(qs[j].value) < 0 })
+
+	total := 0.0
+	for _, q := range qs {
+		total += q.LiquidityUSD
+	}
+
+	median := qs[len(qs)-1].value
+	acc := 0.0
+	for _, q := range qs {
+		acc += q.LiquidityUSD
+		if acc >= total/2 {
+			median = q.value
+			break
+		}
+	}
+
+	if median.Sign() <= 0 {
+		return Decimal{}, 0, false
+	}
+	spread := qs[len(qs)-1].value.Sub(qs[0].value).Quo(median).Float64()
+
+	threshold := DecimalFromFloat(priceOutlierThreshold)
+	sum, weight := Decimal{}, Decimal{}
+	for i := range qs {
+		if qs[i].value.Sub(median).Abs().Quo(median).Cmp(threshold) > 0 {
+			qs[i].Outlier = true
+			continue
+		}
+
+		w := DecimalFromFloat(qs[i].LiquidityUSD)
+		sum = sum.Add(qs[i].value.Mul(w))
+		weight = weight.Add(w)
+	}
+
+	if weight.Sign() <= 0 {
+		return Decimal{}, spread, false
+	}
+
+	return sum.Quo(weight), spread, true
+}
+
+// oldest source of the quotes that went into an aggregate
+func quotesSource(qs []PoolPrice) priceSource {
+	var source priceSource
+	for _, q := range qs {
+		if q.Outlier {
+			continue
+		}
+
+		if source.at.IsZero() {
+			source = q.source
+			continue
+		}
+		source = source.older(q.source)
+	}
+
+	return source
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// T trades against TON and against Y, and Y is priced only through T's
+// second pool. Y quoting T back through that pool is circular and must not
+// weigh into T's price
+func TestAggregateSkipsCircularQuotes(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	ton := testMaster(1, "pTON", 9)
+	token := testMaster(10, "T", 9)
+	other := testMaster(11, "Y", 9)
+
+	direct := testPool(100, ton, token, 1_000_000_000_000, 2_000_000_000_000)
+	second := testPool(101, token, other, 1_000_000_000_000, 4_000_000_000_000)
+	anchor := priceNode{
+		key:       keyOf(ton.addr),
+		currency:  Currency{symbol: "pTON", decimal: 9, value: NewDecimal(5), source: priceSource{block: 1, at: time.Now()}},
+		liquidity: 1e12,
+	}
+
+	prices := buildPriceMap([]*PoolInfo{direct, second}, []priceNode{anchor})
+
+	tp, ok := prices[keyOf(token.addr)]
+	if !ok {
+		t.Fatal("T not priced")
+	}
+	if len(tp.pools) != 1 || tp.pools[0].Pool != direct.addr.String() {
+		t.Errorf("T quoted by %+v, want only its TON pool", tp.pools)
+	}
+	if tp.value.Cmp(NewDecimal(5).Quo(NewDecimal(2))) != 0 {
+		t.Errorf("T price %s, want 2.5", tp.value)
+	}
+
+	yp, ok := prices[keyOf(other.addr)]
+	if !ok || len(yp.pools) != 1 || yp.pools[0].Pool != second.addr.String() {
+		t.Errorf("Y quoted by %+v, want T's second pool", yp.pools)
+	}
+}
@@ -1,21 +1,21 @@
 package main
 
 import (
-	"context"
 	"errors"
 	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/xssnick/tonutils-go/address"
-	"github.com/xssnick/tonutils-go/tlb"
 	"github.com/xssnick/tonutils-go/ton"
 )
 
+// tokens are identified by jetton master address, symbols are display only
+// and can be copied by any jetton. overridden by flags in main
 var (
-	tonSymbol  = "pTON"
-	usdtSymbol = "jUSDT"
+	tonMasterAddr = address.MustParseAddr("EQCM3B12QK1e4yZSf8GtBRT0aLMNyEsBc_DhVfRRtOEffLez")
 )
 
 var (
@@ -26,46 +26,55 @@ var (
 	tonJUSDPoolAddr = address.MustParseAddr("EQAKleHU6-eGDQUfi4YXMNve4UQP0RGAIRkU4AiRRlgDUbaM")
 )
 
+// prices are usd per whole token
 var (
-	tonPrice = big.NewInt(0)
-	usdPrice = big.NewInt(1000_000)
+	oneUSD = NewDecimal(1)
 )
 
 type Currency struct {
+	symbol  string
 	decimal int
-	value   *big.Int
+	// usd per whole token
+	value  Decimal
+	source priceSource
+
+	// nil for anchor assets
+	path *PricePath
+
+	pools  []PoolPrice
+	spread float64
 }
 
+// pools are kept as private copies and prices are published as immutable
+// snapshots, the mutex only serializes writers
 type PriceCollector struct {
 	api ton.APIClientWrapped
 
 	poolInfoMap map[string]*PoolInfo
 	mutex       sync.Mutex
 
-	tonUsdPoolInfo *PoolInfo
-	priceMap       map[string]Currency
+	anchors  []*StableAnchor
+	snapshot atomic.Pointer[PriceSnapshot]
 }
 
-func NewPriceCollector(api ton.APIClientWrapped) *PriceCollector {
+func NewPriceCollector(api ton.APIClientWrapped, anchors []*StableAnchor) *PriceCollector {
 	pc := &PriceCollector{
-		api: api,
+		api:     api,
+		anchors: anchors,
 	}
 
 	pc.poolInfoMap = make(map[string]*PoolInfo)
 	pc.mutex = sync.Mutex{}
-	pc.priceMap = make(map[string]Currency)
+	pc.snapshot.Store(emptyPriceSnapshot)
 
-	pc.tonUsdPoolInfo = &PoolInfo{
-		addr:     tonJUSDPoolAddr,
-		reserve0: big.NewInt(1),
-		reserve1: big.NewInt(1),
-		symbol:   "jUSDT-pTON LP",
-	}
 	return pc
 }
 
-func (pic *PriceCollector) SymbolPriceFriendly(symbol string) string {
-	c, err := pic.SymbolPrice(symbol)
+func (pic *PriceCollector) TokenPriceFriendly(master *JettonMasterInfo) string {
+	c, err := pic.TokenPrice(master)
+	if errors.Is(err, errPriceStale) {
+		return "N/A(stale)"
+	}
 	if err != nil {
 		return "N/A"
 	}
@@ -73,29 +82,97 @@ func (pic *PriceCollector) SymbolPriceFriendly(symbol string) string {
 	return c.String()
 }
 
-func (pic *PriceCollector) SymbolPrice(symbol string) (tlb.Coins, error) {
-	price, ok := pic.priceMap[symbol]
+// usd per whole token of master
+func (pic *PriceCollector) TokenPrice(master *JettonMasterInfo) (Decimal, error) {
+	if master == nil || master.addr == nil {
+		return Decimal{}, errPriceNotFound
+	}
+
+	price, ok := pic.Snapshot().price(master.addr)
 	if !ok {
-		return tlb.Coins{}, errors.New("price not found")
+		return Decimal{}, errPriceNotFound
 	}
-	return tlb.FromNano(price.value, price.decimal)
+
+	if price.source.stale(time.Now()) {
+		return Decimal{}, errPriceStale
+	}
+	return price.value, nil
 }
 
+// exact usd value of amount (in jetton units) of master
+func (pic *PriceCollector) USDAmount(master *JettonMasterInfo, amount *big.Int) (Decimal, bool) {
+	price, err := pic.TokenPrice(master)
+	if err != nil {
+		return Decimal{}, false
+	}
+
+	return DecimalFromUnits(amount, master.decimals).Mul(price), true
+}
+
+// usd value of amount (in jetton units) of master, false if price is unknown
+func (pic *PriceCollector) USDValue(master *JettonMasterInfo, amount *big.Int) (float64, bool) {
+	value, ok := pic.USDAmount(master, amount)
+	if !ok {
+		return 0, false
+	}
+
+	return value.Float64(), true
+}
+
+// latest published prices
+func (pic *PriceCollector) Snapshot() *PriceSnapshot {
+	return pic.snapshot.Load()
+}
+
+// copy of the pool, callers may modify it and hand it back with SetItem
 func (pic *PriceCollector) GetItem(key string) *PoolInfo {
 	pic.mutex.Lock()
 	defer pic.mutex.Unlock()
 
-	return pic.poolInfoMap[key]
+	pi, ok := pic.poolInfoMap[key]
+	if !ok {
+		return nil
+	}
+
+	cp := *pi
+	return &cp
 }
 
+// store a copy of pi unless a copy read at a newer block is stored already,
+// LP jetton data of the stored copy is kept when pi lacks it
 func (pic *PriceCollector) SetItem(key string, pi *PoolInfo) {
+	cp := *pi
+
 	pic.mutex.Lock()
 	defer pic.mutex.Unlock()
 
-	pic.poolInfoMap[key] = pi
+	if stored, ok := pic.poolInfoMap[key]; ok {
+		if stored.block > cp.block {
+			return
+		}
+		if cp.lpTotalSupply == nil && stored.lpTotalSupply != nil {
+			cp.lpJetton, cp.lpAdminAddr, cp.lpTotalSupply, cp.lpMintable, cp.lpOffchainURI = stored.lpJetton, stored.lpAdminAddr, stored.lpTotalSupply, stored.lpMintable, stored.lpOffchainURI
+		}
+	}
+
+	pic.poolInfoMap[key] = &cp
 	pic.updatePriceMap()
 }
 
+// all pools seen so far
+func (pic *PriceCollector) Pools() []*PoolInfo {
+	pic.mutex.Lock()
+	defer pic.mutex.Unlock()
+
+	pools := make([]*PoolInfo, 0, len(pic.poolInfoMap))
+	for _, pi := range pic.poolInfoMap {
+		cp := *pi
+		pools = append(pools, &cp)
+	}
+
+	return pools
+}
+
 func (pic *PriceCollector) DeleteItem(key string) {
 	pic.mutex.Lock()
 	defer pic.mutex.Unlock()
@@ -103,241 +180,127 @@ func (pic *PriceCollector) DeleteItem(key string) {
 	delete(pic.poolInfoMap, key)
 }
 
-func (pic *PriceCollector) TonPrice() *big.Int {
-	return tonPrice
+// usd per TON, zero when unknown or stale
+func (pic *PriceCollector) TonPrice() Decimal {
+	c, ok := pic.Snapshot().price(tonMasterAddr)
+	if !ok || c.source.stale(time.Now()) {
+		return Decimal{}
+	}
+
+	return c.value
 }
 
-func (pic *PriceCollector) displayPriceMap() {
-	for k, v := range pic.priceMap {
-		coin, _ := tlb.FromNano(v.value, v.decimal)
-		log.Debug().Msgf("%s: %s", k, coin.String())
+func (pic *PriceCollector) TonPriceFriendly() string {
+	price := pic.TonPrice()
+	if price.Sign() == 0 {
+		return "N/A"
 	}
+
+	return price.String()
 }
 
+func (pic *PriceCollector) displayPriceMap(ps *PriceSnapshot) {
+	log.Debug().Msgf("price snapshot %d at block %d", ps.version, ps.block)
+	for k, v := range ps.prices {
+		hops := 0
+		if v.path != nil {
+			hops = len(v.path.Pools)
+		}
+		log.Debug().Msgf("%s (%s): %s, %d hops, %d pools, spread %.4f, block %d, stale %t", v.symbol, k, v.value.String(), hops, len(v.pools), v.spread,
+			v.source.block, v.source.stale(ps.at))
+	}
+}
+
+// refresh every stable anchor pool and reprice, a failed anchor keeps its
+// previous pool data
 func (pic *PriceCollector) PeriodicallyGetTONUSDPool() {
-	pic.getTONUSDPoolData(pic.api)
-	pic.updateBasePrice()
+	pic.refreshAnchors()
 
 	ticker := time.NewTicker(interval)
 	for {
 		select {
 		case <-ticker.C:
-			pic.getTONUSDPoolData(pic.api)
-			pic.updateBasePrice()
-			pic.updatePriceMap()
+			pic.refreshAnchors()
 
-			log.Debug().Msgf("latest ton price %s", tlb.FromNanoTON(pic.TonPrice()))
+			log.Debug().Msgf("latest ton price %s", pic.TonPriceFriendly())
 		}
 	}
 }
 
-func (pic *PriceCollector) getTONUSDPoolData(api ton.APIClientWrapped) error {
-	log.Debug().Msgf("get ton USDT LP pool data %s", tonJUSDPoolAddr.String())
-
-	now := time.Now()
-	b, err := api.CurrentMasterchainInfo(context.Background())
-	if err != nil {
-		return err
-	}
-
-	res, err := api.WaitForBlock(b.SeqNo).RunGetMethod(context.Background(), b, tonJUSDPoolAddr, "get_pool_data")
-	if err != nil {
-		return err
-	}
-	log.Debug().Msgf("get_pool_data for ton USDT LP pool took %s", time.Since(now))
+func (pic *PriceCollector) refreshAnchors() {
+	for _, sa := range pic.anchors {
+		log.Debug().Msgf("get %s TON pool data", sa.symbol)
 
-	reserve0 := res.MustInt(0)
-	pic.tonUsdPoolInfo.reserve0 = reserve0
+		info, err := sa.refresh(pic.api)
 
-	reserve1 := res.MustInt(1)
-	pic.tonUsdPoolInfo.reserve1 = reserve1
-
-	token0AddrSlice, err := res.Slice(2)
-	if err != nil {
-		return err
-	}
-	pic.tonUsdPoolInfo.token0Address = token0AddrSlice.MustLoadAddr()
-
-	token1AddrSlice, err := res.Slice(3)
-	if err != nil {
-		return err
-	}
-	pic.tonUsdPoolInfo.token1Address = token1AddrSlice.MustLoadAddr()
-	pic.tonUsdPoolInfo.lpFee = res.MustInt(4).Int64()
-	pic.tonUsdPoolInfo.protocolFee = res.MustInt(5).Int64()
-	pic.tonUsdPoolInfo.refFee = res.MustInt(6).Int64()
-
-	_, _ = res.Slice(7)
-	pic.tonUsdPoolInfo.collectedToken0ProtocolFee = res.MustInt(8)
-	pic.tonUsdPoolInfo.collectedToken1ProtocolFee = res.MustInt(9)
-
-	return nil
-}
-
-func (pic *PriceCollector) updateBasePrice() {
-	if pic.tonUsdPoolInfo != nil {
-		log.Debug().Msgf("update ton price")
-		log.Debug().Msgf("reserve0 %s", pic.tonUsdPoolInfo.reserve0.String())
-		log.Debug().Msgf("reserve1 %s", pic.tonUsdPoolInfo.reserve1.String())
-
-		tonPrice = calculatePriceWithReserveP1(pic.tonUsdPoolInfo.reserve0, pic.tonUsdPoolInfo.reserve1, 6, 9, usdPrice)
-		pic.priceMap[tonSymbol] = Currency{
-			decimal: 9,
-			value:   tonPrice,
+		pic.mutex.Lock()
+		if err != nil {
+			sa.err = err
+		} else {
+			sa.info, sa.err = info, nil
 		}
+		pic.mutex.Unlock()
 
-		pic.priceMap[usdtSymbol] = Currency{
-			decimal: 6,
-			value:   usdPrice,
+		if err != nil {
+			log.Warn().Err(err).Msgf("failed to refresh %s TON pool, its price goes stale after %s", sa.symbol, priceMaxAge)
 		}
-
-		log.Debug().Msgf("new ton price %s", tlb.FromNanoTON(tonPrice).String())
-
 	}
+
+	pic.mutex.Lock()
+	pic.updatePriceMap()
+	pic.mutex.Unlock()
 }
 
-// suppose each jetton decimal is 9
-func calculatePriceWithReserveP0(reserve0, reserve1 *big.Int, d0, d1 int, price1 *big.Int) *big.Int {
+// price of token0 from the price of token1, exact: price1 * (reserve1 /
+// 10^d1) / (reserve0 / 10^d0)
+func calculatePriceWithReserveP0(reserve0, reserve1 *big.Int, d0, d1 int, price1 Decimal) Decimal {
 	log.Debug().Msgf("calculate price with reserve0 %s, reserve1 %s, d0 %d, d1 %d, price1 %s", reserve0.String(), reserve1.String(), d0, d1, price1.String())
-	t1cap := new(big.Float).Quo(
-		// reserve1 * price1
-		new(big.Float).Mul(
-			new(big.Float).SetInt(reserve1),
-			new(big.Float).SetInt(price1),
-		),
-
-		// 10 ** (decimals)
-		new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d1)), nil)),
-	)
 
-	t0price := new(big.Float).Quo(
-		// t1cap * decimal
-		new(big.Float).Mul(t1cap, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d0)), nil))),
-		// reserve0
-		new(big.Float).SetInt(reserve0),
-	)
+	price0 := price1.Mul(DecimalFromUnits(reserve1, d1)).Quo(DecimalFromUnits(reserve0, d0))
+	log.Debug().Msgf("calulated new price0 %s", price0.String())
 
-	priceInt, _ := t0price.Int(new(big.Int))
-
-	log.Debug().Msgf("calulated new price0 %s", priceInt.String())
-
-	return priceInt
+	return price0
 }
 
-// suppose each jetton decimal is 9
-func calculatePriceWithReserveP1(reserve0, reserve1 *big.Int, d0, d1 int, price0 *big.Int) *big.Int {
+// price of token1 from the price of token0, exact: price0 * (reserve0 /
+// 10^d0) / (reserve1 / 10^d1)
+func calculatePriceWithReserveP1(reserve0, reserve1 *big.Int, d0, d1 int, price0 Decimal) Decimal {
 	log.Debug().Msgf("calculate price with reserve0 %s, reserve1 %s, d0 %d, d1 %d, price0 %s", reserve0.String(), reserve1.String(), d0, d1, price0.String())
 
-	r0 := new(big.Float).SetInt(reserve0)
-	r1 := new(big.Float).SetInt(reserve1)
-	p0 := new(big.Float).SetInt(price0)
-
-	if d0 > d1 {
-		r1.Mul(r1, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d0-d1)), nil)))
-	} else {
-		r0.Mul(r0, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d1-d0)), nil)))
-	}
-
-	t1price := new(big.Float).Quo(
-		// reserve0 * price0
-		new(big.Float).Mul(r0, p0),
-		r1,
-	)
-
-	priceInt, _ := t1price.Int(new(big.Int))
-	log.Debug().Msgf("calulated new price1 %s", priceInt.String())
-	return priceInt
-
-	//t0cap := new(big.Float).Mul(
-	//	// reserve0 * price0
-	//	new(big.Float).Mul(new(big.Float).SetInt(reserve0), new(big.Float).SetInt(price0)),
-
-	//	// 10 ** (decimals)
-	//	new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d1)), nil)),
-	//)
-
-	//fmt.Printf("t0cap %s\n", t0cap.String())
-	//fmt.Printf("1110 %s\n", new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d1)), nil).String())
-
-	//t1price := new(big.Float).Quo(
-	//	// t0cap
-	//	t0cap,
-	//	new(big.Float).Mul(new(big.Float).SetInt(reserve1), new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d0)), nil))),
-	//)
-
-	//fmt.Printf("t1price %s\n", t1price.String())
-	//priceInt, _ := t1price.Int(new(big.Int))
-	//log.Debug().Msgf("calulated new price1 %s", priceInt.String())
-
-	//return priceInt
+	price1 := price0.Mul(DecimalFromUnits(reserve0, d0)).Quo(DecimalFromUnits(reserve1, d1))
+	log.Debug().Msgf("calulated new price1 %s", price1.String())
 
+	return price1
 }
 
+// build and publish a new snapshot from current pools, called with mutex held
 func (pic *PriceCollector) updatePriceMap() {
-	//pic.mutex.Lock()
-	//defer pic.mutex.Unlock()
-
-	// shortcut if ton price is missing
-	if pic.tonUsdPoolInfo == nil {
-		return
-	}
+	now := time.Now()
+	anchors, statuses := combineAnchors(pic.anchors, now)
 
+	pools := make([]*PoolInfo, 0, len(pic.poolInfoMap)+len(pic.anchors))
 	for _, pi := range pic.poolInfoMap {
-		if pi.token0JettonMaster == nil || pi.token1JettonMaster == nil {
-			continue
-		}
-
-		log.Debug().Msgf("update price for %s-%s, current ton price is %s", pi.token0JettonMaster.symbol, pi.token1JettonMaster.symbol, tonPrice.String())
-
-		if pi.token0JettonMaster.symbol == tonSymbol {
-			newToken1Price := calculatePriceWithReserveP1(
-				pi.reserve0,
-				pi.reserve1,
-				pi.token0JettonMaster.decimals,
-				pi.token1JettonMaster.decimals,
-				tonPrice)
-			pic.priceMap[pi.token1JettonMaster.symbol] = Currency{
-				decimal: pi.token1JettonMaster.decimals,
-				value:   newToken1Price,
-			}
-		}
+		pools = append(pools, pi)
+	}
+	pools = freshPools(pools, now)
 
-		if pi.token1JettonMaster.symbol == tonSymbol {
-			newToken0Price := calculatePriceWithReserveP0(pi.reserve0,
-				pi.reserve1,
-				pi.token0JettonMaster.decimals,
-				pi.token1JettonMaster.decimals,
-				tonPrice)
-			pic.priceMap[pi.token0JettonMaster.symbol] = Currency{
-				decimal: pi.token0JettonMaster.decimals,
-				value:   newToken0Price,
-			}
-		}
+	prices := buildPriceMap(pools, anchors)
+	carryOverPrices(prices, pic.Snapshot().prices, now)
 
-		if pi.token0JettonMaster.symbol == usdtSymbol {
-			newToken1Price := calculatePriceWithReserveP1(pi.reserve0,
-				pi.reserve1,
-				6,
-				pi.token1JettonMaster.decimals,
-				usdPrice)
-			pic.priceMap[pi.token1JettonMaster.symbol] = Currency{
-				decimal: pi.token1JettonMaster.decimals,
-				value:   newToken1Price,
-			}
+	for _, sa := range pic.anchors {
+		if sa.info != nil {
+			pools = append(pools, sa.info)
 		}
+	}
 
-		if pi.token1JettonMaster.symbol == usdtSymbol {
-			newToken0Price := calculatePriceWithReserveP0(pi.reserve0,
-				pi.reserve1,
-				pi.token0JettonMaster.decimals,
-				6,
-				usdPrice)
-			pic.priceMap[pi.token0JettonMaster.symbol] = Currency{
-				decimal: pi.token0JettonMaster.decimals,
-				value:   newToken0Price,
-			}
-		}
+	ps := &PriceSnapshot{
+		version: pic.Snapshot().version + 1,
+		block:   maxPoolBlock(pools),
+		at:      now,
+		prices:  prices,
+		anchors: statuses,
 	}
 
-	pic.displayPriceMap()
+	pic.snapshot.Store(ps)
+	pic.displayPriceMap(ps)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+func testAddr(i byte) *address.Address {
+	hash := make([]byte, 32)
+	hash[0], hash[31] = 0xd0, i
+	return address.NewAddress(0, 0, hash)
+}
+
+func testMaster(i byte, symbol string, decimals int) *JettonMasterInfo {
+	return &JettonMasterInfo{addr: testAddr(i), symbol: symbol, decimals: decimals}
+}
+
+func testPool(i byte, token0, token1 *JettonMasterInfo, reserve0, reserve1 int64) *PoolInfo {
+	return &PoolInfo{
+		addr:               testAddr(i),
+		token0JettonMaster: token0,
+		token1JettonMaster: token1,
+		reserve0:           big.NewInt(reserve0),
+		reserve1:           big.NewInt(reserve1),
+		block:              uint32(i),
+		updatedAt:          time.Now(),
+	}
+}
+
+// writers add pools and reprice while readers go through published
+// snapshots, run with -race
+func TestPriceCollectorConcurrentSnapshots(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	ton := testMaster(1, "pTON", 9)
+	defer func(addr *address.Address) { tonMasterAddr = addr }(tonMasterAddr)
+	tonMasterAddr = ton.addr
+	usdt := testMaster(2, "USDT", 6)
+	anchor := &StableAnchor{symbol: "USDT", master: usdt.addr, info: testPool(100, ton, usdt, 1_000_000_000_000_000, 5_000_000_000_000)}
+
+	pic := NewPriceCollector(nil, []*StableAnchor{anchor})
+	tokens := make([]*JettonMasterInfo, 0)
+	for i := byte(0); i < 8; i++ {
+		tokens = append(tokens, testMaster(10+i, "T", 9))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				token := tokens[(w+n)%len(tokens)]
+				pool := testPool(byte(200+(w+n)%len(tokens)), ton, token, int64(1_000_000_000+n), int64(2_000_000_000+w))
+				pic.SetItem(pool.addr.String(), pool)
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				ps := pic.Snapshot()
+				for _, token := range tokens {
+					if c, ok := ps.price(token.addr); ok && c.value.Sign() <= 0 {
+						t.Errorf("non positive price %s", c.value)
+					}
+				}
+				pic.TonPrice()
+				pic.Pools()
+			}
+		}()
+	}
+	wg.Wait()
+
+	ps := pic.Snapshot()
+	if ps.Version() == 0 {
+		t.Fatal("no snapshot published")
+	}
+	for _, token := range tokens {
+		if _, ok := ps.price(token.addr); !ok {
+			t.Errorf("token %s not priced", token.addr)
+		}
+	}
+	if c, ok := ps.price(ton.addr); !ok || c.value.Cmp(NewDecimal(5)) != 0 {
+		t.Errorf("TON price %v, want 5", c.value)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+// averaging windows, default for every token then per token overrides:
+// "5m,1h;<jetton master>=1m,15m"
+var defaultPriceWindows = "5m,1h"
+
+type priceWindow struct {
+	name     string
+	duration time.Duration
+}
+
+type priceObservation struct {
+	at     time.Time
+	price  Decimal
+	volume Decimal
+}
+
+// averages of one window next to the spot price, nil when nothing was
+// observed within the window
+type PriceFeed struct {
+	Window string `json:"window"`
+
+	// time weighted over sampled snapshot prices, stale when the price
+	// stopped being sampled fresh and the TWAP only covers the time before
+	TWAP             *Decimal `json:"twap"`
+	TWAPObservations int      `json:"twap_observations"`
+	Stale            bool     `json:"stale"`
+
+	// volume weighted over swaps
+	VWAP       *Decimal `json:"vwap"`
+	VWAPTrades int      `json:"vwap_trades"`
+	Volume     Decimal  `json:"volume"`
+}
+
+// spot prices sampled from price snapshots and swap prices per token, kept
+// for the longest window of the token
+type PriceFeeds struct {
+	mutex    sync.Mutex
+	defaults []priceWindow
+	windows  map[addrKey][]priceWindow
+
+	spots  map[addrKey][]priceObservation
+	trades map[addrKey][]priceObservation
+}
+
+func NewPriceFeeds(config string) (*PriceFeeds, error) {
+	pf := &PriceFeeds{
+		mutex:   sync.Mutex{},
+		windows: make(map[addrKey][]priceWindow),
+		spots:   make(map[addrKey][]priceObservation),
+		trades:  make(map[addrKey][]priceObservation),
+	}
+
+	for _, part := range strings.Split(config, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		master, list := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			master, list = part[:i], part[i+1:]
+		}
+
+		windows, err := parsePriceWindows(list)
+		if err != nil {
+			return nil, err
+		}
+
+		if master == "" {
+			pf.defaults = windows
+			continue
+		}
+
+		addr, err := address.ParseAddr(strings.TrimSpace(master))
+		if err != nil {
+			return nil, err
+		}
+		pf.windows[keyOf(addr)] = windows
+	}
+
+	return pf, nil
+}
+
+func parsePriceWindows(s string) ([]priceWindow, error) {
+	windows := make([]priceWindow, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		d, err := parseWindowDuration(name)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, priceWindow{name: name, duration: d})
+	}
+
+	return windows, nil
+}
+
+// time.ParseDuration plus days, "1d"
+func parseWindowDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid window %s", s)
+	}
+
+	return d, nil
+}
+
+func (pf *PriceFeeds) windowsOf(key addrKey) []priceWindow {
+	if windows, ok := pf.windows[key]; ok {
+		return windows
+	}
+
+	return pf.defaults
+}
+
+func (pf *PriceFeeds) retention(key addrKey) time.Duration {
+	longest := time.Duration(0)
+	for _, w := range pf.windowsOf(key) {
+		if w.duration > longest {
+			longest = w.duration
+		}
+	}
+
+	return longest
+}
+
+// drop observations older than retention, keeping the last one before the
+// cutoff since its price holds until the next observation
+func pruneObservations(obs []priceObservation, cutoff time.Time, keepLast bool) []priceObservation {
+	i := 0
+	for i < len(obs) && obs[i].at.Before(cutoff) {
+		i++
+	}
+
+	if keepLast && i > 0 {
+		i--
+	}
+
+	return obs[i:]
+}
+
+// how long a sampled price holds, two sampling intervals so a late tick
+// leaves no gap
+func sampleHold() time.Duration {
+	return 2 * interval
+}
+
+// insert o in time order, trades may be recorded out of order
+func insertObservation(obs []priceObservation, o priceObservation) []priceObservation {
+	i := len(obs)
+	for i > 0 && obs[i-1].at.After(o.at) {
+		i--
+	}
+
+	obs = append(obs, priceObservation{})
+	copy(obs[i+1:], obs[i:])
+	obs[i] = o
+	return obs
+}
+
+// sample every fresh price of a snapshot at now
+func (pf *PriceFeeds) Sample(ps *PriceSnapshot, now time.Time) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	for key, c := range ps.prices {
+		if c.source.stale(now) {
+			continue
+		}
+
+		obs := append(pf.spots[key], priceObservation{at: now, price: c.value})
+		pf.spots[key] = pruneObservations(obs, now.Add(-pf.retention(key)), true)
+	}
+}
+
+// usd prices the swap executed at and amounts of both tokens of it. a
+// token's price is what the other side paid for it, valued at the other
+// token's usd price, so the VWAP follows executions, not the oracle
+func (pf *PriceFeeds) Record(sa *SwapAction) {
+	t, ok := tradeOf(sa)
+	if !ok {
+		return
+	}
+
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	usd0, usd1 := t.executedUSD()
+	sides := []struct {
+		master string
+		price  Decimal
+		amount Decimal
+	}{{t.Token0, usd0, t.Amount0}, {t.Token1, usd1, t.Amount1}}
+
+	for _, side := range sides {
+		addr, err := address.ParseAddr(side.master)
+		if err != nil || side.price.Sign() <= 0 || side.amount.Sign() <= 0 {
+			continue
+		}
+
+		key := keyOf(addr)
+		obs := insertObservation(pf.trades[key], priceObservation{at: t.At, price: side.price, volume: side.amount})
+		pf.trades[key] = pruneObservations(obs, time.Now().Add(-pf.retention(key)), false)
+	}
+}
+
+// TWAP and VWAP of master over each of its windows
+func (pf *PriceFeeds) Feeds(master *address.Address) []PriceFeed {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	key := keyOf(master)
+	now := time.Now()
+
+	feeds := make([]PriceFeed, 0)
+	for _, w := range pf.windowsOf(key) {
+		from := now.Add(-w.duration)
+		feed := PriceFeed{Window: w.name}
+
+		feed.TWAP, feed.TWAPObservations, feed.Stale = twap(pf.spots[key], from, now, sampleHold())
+		feed.VWAP, feed.Volume, feed.VWAPTrades = vwap(pf.trades[key], from)
+
+		feeds = append(feeds, feed)
+	}
+
+	return feeds
+}
+
+// averages over the shortest window of every sampled token
+func (pf *PriceFeeds) shortestFeeds(now time.Time) map[addrKey]PriceFeed {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	feeds := make(map[addrKey]PriceFeed, len(pf.spots))
+	for key, obs := range pf.spots {
+		windows := pf.windowsOf(key)
+		if len(windows) == 0 {
+			continue
+		}
+
+		w := windows[0]
+		for _, o := range windows[1:] {
+			if o.duration < w.duration {
+				w = o
+			}
+		}
+
+		from := now.Add(-w.duration)
+		feed := PriceFeed{Window: w.name}
+		feed.TWAP, feed.TWAPObservations, feed.Stale = twap(obs, from, now, sampleHold())
+		feed.VWAP, feed.Volume, feed.VWAPTrades = vwap(pf.trades[key], from)
+		feeds[key] = feed
+	}
+
+	return feeds
+}
+
+// each observed price holds until the next observation but no longer than
+// hold, the sampling interval, weighted by how long of [from, to] it held.
+// stale when the last observation no longer holds at to, prices are only
+// sampled while fresh
+func twap(obs []priceObservation, from, to time.Time, hold time.Duration) (*Decimal, int, bool) {
+	sum, total, n := Decimal{}, Decimal{}, 0
+	stale := len(obs) == 0 || to.Sub(obs[len(obs)-1].at) > hold
+	for i, o := range obs {
+		start, end := o.at, to
+		if i+1 < len(obs) {
+			end = obs[i+1].at
+		}
+		if held := o.at.Add(hold); end.After(held) {
+			end = held
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if !end.After(start) {
+			continue
+		}
+
+		weight := NewDecimal(int64(end.Sub(start)))
+		sum = sum.Add(o.price.Mul(weight))
+		total = total.Add(weight)
+		n++
+	}
+
+	if total.Sign() == 0 {
+		return nil, 0, stale
+	}
+
+	avg := sum.Quo(total)
+	return &avg, n, stale
+}
+
+func vwap(obs []priceObservation, from time.Time) (*Decimal, Decimal, int) {
+	sum, volume, n := Decimal{}, Decimal{}, 0
+	for _, o := range obs {
+		if o.at.Before(from) {
+			continue
+		}
+
+		sum = sum.Add(o.price.Mul(o.volume))
+		volume = volume.Add(o.volume)
+		n++
+	}
+
+	if volume.Sign() == 0 {
+		return nil, volume, 0
+	}
+
+	avg := sum.Quo(volume)
+	return &avg, volume, n
+}
+
+func (pf *PriceFeeds) PeriodicallySample() {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		pf.Sample(priceCollector.Snapshot(), time.Now())
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a price that stopped being sampled fresh half an hour ago only counts
+// for the time it was sampled and flags the TWAP stale
+func TestTWAPStopsAtLastFreshSample(t *testing.T) {
+	now := time.Now()
+	hold := time.Minute
+	obs := []priceObservation{
+		{at: now.Add(-60 * time.Minute), price: NewDecimal(1)},
+		{at: now.Add(-59 * time.Minute), price: NewDecimal(3)},
+	}
+
+	avg, n, stale := twap(obs, now.Add(-time.Hour), now, hold)
+	if avg == nil || avg.Cmp(NewDecimal(2)) != 0 || n != 2 || !stale {
+		t.Errorf("twap %v over %d observations, stale %v, want 2 over 2, stale", avg, n, stale)
+	}
+
+	obs = append(obs, priceObservation{at: now.Add(-30 * time.Second), price: NewDecimal(5)})
+	// a minute at 1 and at 3, then 30s at 5
+	want := NewDecimal(13).Quo(NewDecimal(5))
+	if avg, _, stale = twap(obs, now.Add(-time.Hour), now, hold); stale || avg.Cmp(want) != 0 {
+		t.Errorf("twap %v, stale %v after a fresh sample, want %s, fresh", avg, stale, want)
+	}
+}
+
+func TestInsertObservationKeepsTimeOrder(t *testing.T) {
+	now := time.Now()
+	obs := make([]priceObservation, 0)
+	for _, minutes := range []int{5, 3, 4, 1, 2} {
+		obs = insertObservation(obs, priceObservation{at: now.Add(-time.Duration(minutes) * time.Minute)})
+	}
+
+	for i := 1; i < len(obs); i++ {
+		if obs[i].at.Before(obs[i-1].at) {
+			t.Fatalf("observation %d at %s before %s", i, obs[i].at, obs[i-1].at)
+		}
+	}
+
+	if pruned := pruneObservations(obs, now.Add(-150*time.Second), false); len(pruned) != 2 {
+		t.Errorf("kept %d observations within the cutoff, want 2", len(pruned))
+	}
+}
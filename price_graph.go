@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+var errPriceNotFound = errors.New("price not found")
+
+// how a token price was derived, tokens and pools from the anchor asset to
+// the priced token
+type PricePath struct {
+	Tokens []string `json:"tokens"`
+	Pools  []string `json:"pools"`
+	// usd depth of the shallowest pool on the path
+	LiquidityUSD float64 `json:"liquidity_usd"`
+}
+
+type TokenPriceInfo struct {
+	Master   string     `json:"master"`
+	Symbol   string     `json:"symbol"`
+	PriceUSD float64    `json:"price_usd"`
+	Path     *PricePath `json:"path"`
+
+	// oldest pool data the price comes from, stale past priceMaxAge
+	Block     uint32    `json:"block"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Stale     bool      `json:"stale"`
+
+	// per pool prices, spread is (max - min) / median across them
+	Spread float64     `json:"spread"`
+	Pools  []PoolPrice `json:"pools"`
+
+	// TWAP and VWAP over the configured windows
+	Feeds []PriceFeed `json:"feeds"`
+}
+
+type priceEdge struct {
+	pool *PoolInfo
+	// index of the token on the other side of the pool
+	to int
+}
+
+type priceNode struct {
+	key       addrKey
+	currency  Currency
+	liquidity float64
+}
+
+// max heap on path liquidity
+type priceQueue []*priceNode
+
+func (q priceQueue) Len() int            { return len(q) }
+func (q priceQueue) Less(i, j int) bool  { return q[i].liquidity > q[j].liquidity }
+func (q priceQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *priceQueue) Push(x interface{}) { *q = append(*q, x.(*priceNode)) }
+func (q *priceQueue) Pop() interface{} {
+	old := *q
+	n := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return n
+}
+
+// usd depth of one side of a pool given the price of that side
+func sideLiquidityUSD(reserve *big.Int, decimals int, price Decimal) float64 {
+	return DecimalFromUnits(reserve, decimals).Mul(price).Float64()
+}
+
+// price every token reachable from the anchors through the pool graph. the
+// path with the deepest bottleneck pool decides which tokens are reachable
+// and is recorded, the price itself is aggregated over all pools
+func buildPriceMap(pools []*PoolInfo, anchors []priceNode) map[addrKey]Currency {
+	edges := make(map[addrKey][]priceEdge)
+	for _, pi := range pools {
+		if pi.token0JettonMaster == nil || pi.token1JettonMaster == nil {
+			continue
+		}
+		if pi.reserve0 == nil || pi.reserve1 == nil || pi.reserve0.Sign() <= 0 || pi.reserve1.Sign() <= 0 {
+			continue
+		}
+
+		k0, k1 := keyOf(pi.token0JettonMaster.addr), keyOf(pi.token1JettonMaster.addr)
+		edges[k0] = append(edges[k0], priceEdge{pool: pi, to: 1})
+		edges[k1] = append(edges[k1], priceEdge{pool: pi, to: 0})
+	}
+
+	isAnchor := make(map[addrKey]bool)
+	queue := &priceQueue{}
+	for i := range anchors {
+		isAnchor[anchors[i].key] = true
+		heap.Push(queue, &anchors[i])
+	}
+
+	prices := make(map[addrKey]Currency)
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(*priceNode)
+		if _, ok := prices[node.key]; ok {
+			continue
+		}
+		prices[node.key] = node.currency
+
+		for _, e := range edges[node.key] {
+			pi, from := e.pool, 1-e.to
+			toMaster := pi.tokenMaster(e.to)
+			toKey := keyOf(toMaster.addr)
+			if _, ok := prices[toKey]; ok || isAnchor[toKey] {
+				continue
+			}
+
+			var value Decimal
+			if e.to == 1 {
+				value = calculatePriceWithReserveP1(pi.reserve0, pi.reserve1, pi.token0JettonMaster.decimals, pi.token1JettonMaster.decimals, node.currency.value)
+			} else {
+				value = calculatePriceWithReserveP0(pi.reserve0, pi.reserve1, pi.token0JettonMaster.decimals, pi.token1JettonMaster.decimals, node.currency.value)
+			}
+
+			reserveFrom := pi.reserve0
+			if from == 1 {
+				reserveFrom = pi.reserve1
+			}
+			liquidity := math.Min(node.liquidity, sideLiquidityUSD(reserveFrom, pi.tokenMaster(from).decimals, node.currency.value))
+
+			path := &PricePath{LiquidityUSD: liquidity}
+			if parent := node.currency.path; parent != nil {
+				path.Tokens = append(path.Tokens, parent.Tokens...)
+				path.Pools = append(path.Pools, parent.Pools...)
+			} else {
+				path.Tokens = []string{pi.tokenMaster(from).addr.String()}
+			}
+			path.Tokens = append(path.Tokens, toMaster.addr.String())
+			path.Pools = append(path.Pools, pi.addr.String())
+
+			heap.Push(queue, &priceNode{
+				key: toKey,
+				currency: Currency{
+					symbol:  toMaster.symbol,
+					decimal: toMaster.decimals,
+					value:   value,
+					source:  node.currency.source.older(poolSource(pi)),
+					path:    path,
+				},
+				liquidity: liquidity,
+			})
+		}
+	}
+
+	aggregatePrices(pools, prices, isAnchor)
+	return prices
+}
+
+// price of master with the path it was derived through
+func (pic *PriceCollector) TokenPriceInfo(master *address.Address) (*TokenPriceInfo, error) {
+	price, ok := pic.Snapshot().price(master)
+	if !ok {
+		return nil, errPriceNotFound
+	}
+
+	return &TokenPriceInfo{
+		Master:   master.String(),
+		Symbol:   price.symbol,
+		PriceUSD: price.value.Float64(),
+		Path:     price.path,
+
+		Block:     price.source.block,
+		UpdatedAt: price.source.at,
+		Stale:     price.source.stale(time.Now()),
+		Spread:    price.spread,
+		Pools:     append(make([]PoolPrice, 0, len(price.pools)), price.pools...),
+	}, nil
+}
+
+func handlePrice(rw http.ResponseWriter, req *http.Request) {
+	master, err := address.ParseAddr(req.URL.Query().Get("token"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	info, err := priceCollector.TokenPriceInfo(master)
+	if err != nil {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	if priceFeeds != nil {
+		info.Feeds = priceFeeds.Feeds(master)
+	}
+
+	writeJSON(rw, http.StatusOK, info)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+// how often a price snapshot is recorded and how long records are kept in
+// memory and in the history log, overridden by flag in main
+var (
+	priceHistoryInterval  = time.Minute
+	priceHistoryRetention = 7 * 24 * time.Hour
+)
+
+// masterchain blocks come about this often
+const masterchainBlockInterval = 5 * time.Second
+
+var (
+	errNoPriceHistory   = errors.New("no recorded price for token")
+	errBlockNotRecorded = errors.New("block is past the newest price record")
+)
+
+// prices of one snapshot as recorded, tokens keyed by keyOf
+type PriceRecord struct {
+	Version uint64    `json:"version"`
+	Block   uint32    `json:"block"`
+	At      time.Time `json:"at"`
+	TONUSD  Decimal   `json:"ton_usd"`
+
+	Prices map[string]RecordedPrice `json:"prices"`
+}
+
+type RecordedPrice struct {
+	PriceUSD Decimal `json:"price_usd"`
+	// logged only when the route changed since the token's previous record
+	// of the day, filled in from it on load
+	Path *PricePath `json:"path,omitempty"`
+	// oldest pool data the price comes from
+	Block uint32 `json:"block"`
+	Stale bool   `json:"stale"`
+
+	// TWAP over the shortest window of the token, nil before any sample
+	TWAP       *Decimal `json:"twap,omitempty"`
+	TWAPWindow string   `json:"twap_window,omitempty"`
+}
+
+// price of one token at one recorded snapshot
+type PricePoint struct {
+	At time.Time `json:"at"`
+	// highest block the snapshot was priced from, the price holds from it on
+	SnapshotBlock uint32 `json:"snapshot_block"`
+
+	RecordedPrice
+}
+
+// recorded price snapshots, oldest first
+type PriceHistory struct {
+	mutex   sync.Mutex
+	records []*PriceRecord
+
+	// route last logged per token and the day it was logged on, every
+	// segment day logs each route once so it reads without earlier days
+	loggedDay    string
+	loggedRoutes map[string]string
+}
+
+func NewPriceHistory() *PriceHistory {
+	return &PriceHistory{
+		mutex:        sync.Mutex{},
+		records:      make([]*PriceRecord, 0),
+		loggedRoutes: make(map[string]string),
+	}
+}
+
+func pathRoute(p *PricePath) string {
+	if p == nil {
+		return ""
+	}
+
+	return strings.Join(p.Tokens, ",") + "|" + strings.Join(p.Pools, ",")
+}
+
+// record ps unless it was recorded already or the last record is more recent
+// than priceHistoryInterval
+func (ph *PriceHistory) Record(ps *PriceSnapshot, feeds map[addrKey]PriceFeed) {
+	if ps.version == 0 {
+		return
+	}
+
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	if n := len(ph.records); n > 0 {
+		last := ph.records[n-1]
+		if last.Version == ps.version || ps.at.Sub(last.At) < priceHistoryInterval {
+			return
+		}
+	}
+
+	r := &PriceRecord{
+		Version: ps.version,
+		Block:   ps.block,
+		At:      ps.at,
+		TONUSD:  ps.tonPrice(),
+		Prices:  make(map[string]RecordedPrice, len(ps.prices)),
+	}
+	for key, c := range ps.prices {
+		rp := RecordedPrice{
+			PriceUSD: c.value,
+			Path:     c.path,
+			Block:    c.source.block,
+			Stale:    c.source.stale(ps.at),
+		}
+		if feed, ok := feeds[key]; ok && feed.TWAP != nil {
+			rp.TWAP, rp.TWAPWindow = feed.TWAP, feed.Window
+		}
+		r.Prices[key.String()] = rp
+	}
+
+	ph.records = append(ph.records, r)
+	ph.prune(ps.at)
+	historyLog.Append(r.At, ph.logged(r))
+}
+
+// r with the paths whose route didn't change left out, called with mutex
+// held. the liquidity of a left out path stays the one logged with its route
+func (ph *PriceHistory) logged(r *PriceRecord) *PriceRecord {
+	if day := segmentDay(r.At); day != ph.loggedDay {
+		ph.loggedDay, ph.loggedRoutes = day, make(map[string]string)
+	}
+
+	lr := *r
+	lr.Prices = make(map[string]RecordedPrice, len(r.Prices))
+	for key, rp := range r.Prices {
+		route := pathRoute(rp.Path)
+		last, ok := ph.loggedRoutes[key]
+		switch {
+		case ok && last == route:
+			rp.Path = nil
+		case rp.Path == nil:
+			// an empty path logs that the token lost its route
+			rp.Path = &PricePath{}
+		}
+		ph.loggedRoutes[key] = route
+		lr.Prices[key] = rp
+	}
+
+	return &lr
+}
+
+// drop records older than priceHistoryRetention
+func (ph *PriceHistory) prune(now time.Time) {
+	cutoff := now.Add(-priceHistoryRetention)
+
+	i := 0
+	for i < len(ph.records) && ph.records[i].At.Before(cutoff) {
+		i++
+	}
+	ph.records = ph.records[i:]
+}
+
+// load logged records at startup, paths left out are carried forward from
+// the token's previous record
+func (ph *PriceHistory) Load(hl *SegmentLog) {
+	records := make([]*PriceRecord, 0)
+	paths := make(map[string]*PricePath)
+	err := hl.Each(func(value json.RawMessage) {
+		r := new(PriceRecord)
+		if err := json.Unmarshal(value, r); err != nil {
+			return
+		}
+
+		for key, rp := range r.Prices {
+			switch {
+			case rp.Path == nil:
+				rp.Path = paths[key]
+			case len(rp.Path.Tokens) == 0:
+				rp.Path = nil
+			}
+			paths[key] = rp.Path
+			r.Prices[key] = rp
+		}
+		records = append(records, r)
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to load price records from %s", hl.dir)
+		return
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].At.Before(records[j].At) })
+
+	ph.mutex.Lock()
+	ph.records = records
+	ph.prune(time.Now())
+	ph.mutex.Unlock()
+
+	log.Info().Msgf("loaded %d price records from %s", len(records), hl.dir)
+}
+
+// prices of master recorded within [from, to], oldest first. with a
+// resolution only the last record of each resolution long bucket is kept
+func (ph *PriceHistory) History(master *address.Address, from, to time.Time, resolution time.Duration) []PricePoint {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	key := keyOf(master).String()
+	points := make([]PricePoint, 0)
+	for _, r := range ph.records {
+		if r.At.Before(from) || r.At.After(to) {
+			continue
+		}
+
+		rp, ok := r.Prices[key]
+		if !ok {
+			continue
+		}
+
+		point := PricePoint{At: r.At, SnapshotBlock: r.Block, RecordedPrice: rp}
+		if n := len(points); n > 0 && resolution > 0 && points[n-1].At.Truncate(resolution).Equal(r.At.Truncate(resolution)) {
+			points[n-1] = point
+			continue
+		}
+		points = append(points, point)
+	}
+
+	return points
+}
+
+// price of master at block, from the last record priced from pool data no
+// newer than block. blocks more than a record interval past the newest
+// record are not recorded yet, errBlockNotRecorded
+func (ph *PriceHistory) AtBlock(master *address.Address, block uint32) (PricePoint, error) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	if n := len(ph.records); n > 0 {
+		span := uint32(priceHistoryInterval / masterchainBlockInterval)
+		if block > ph.records[n-1].Block+span {
+			return PricePoint{}, errBlockNotRecorded
+		}
+	}
+
+	key := keyOf(master).String()
+	for i := len(ph.records) - 1; i >= 0; i-- {
+		r := ph.records[i]
+		if r.Block > block {
+			continue
+		}
+
+		if rp, ok := r.Prices[key]; ok {
+			return PricePoint{At: r.At, SnapshotBlock: r.Block, RecordedPrice: rp}, nil
+		}
+	}
+
+	return PricePoint{}, errNoPriceHistory
+}
+
+func (ph *PriceHistory) PeriodicallyRecord() {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		feeds := make(map[addrKey]PriceFeed)
+		if priceFeeds != nil {
+			feeds = priceFeeds.shortestFeeds(time.Now())
+		}
+
+		ph.Record(priceCollector.Snapshot(), feeds)
+	}
+}
+
+// /price/history?token=<master>&resolution=5m, optional from and to as unix
+// seconds or RFC3339, or /price/history?token=<master>&block=<seqno>
+func handlePriceHistory(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	master, err := address.ParseAddr(query.Get("token"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	if query.Get("block") != "" {
+		block, err := strconv.ParseUint(query.Get("block"), 10, 32)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+
+		point, err := priceHistory.AtBlock(master, uint32(block))
+		if err != nil {
+			writeError(rw, http.StatusNotFound, err)
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, point)
+		return
+	}
+
+	resolution := time.Duration(0)
+	if query.Get("resolution") != "" {
+		resolution, err = parseWindowDuration(query.Get("resolution"))
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	to, err := parseTimeParam(query.Get("to"), time.Now())
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	from, err := parseTimeParam(query.Get("from"), time.Time{})
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, priceHistory.History(master, from, to, resolution))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func testSnapshot(version uint64, at time.Time, prices map[addrKey]Currency) *PriceSnapshot {
+	return &PriceSnapshot{version: version, block: uint32(version), at: at, prices: prices}
+}
+
+// paths are logged once per route and day, loading fills the left out ones
+// in from the previous record of the token
+func TestPriceHistoryLogsPathsOnChange(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	defer func(sl *SegmentLog) { historyLog = sl }(historyLog)
+	var err error
+	if historyLog, err = OpenSegmentLog(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	token := keyOf(testAddr(10))
+	direct := &PricePath{Tokens: []string{"T", "pTON"}, Pools: []string{"a"}, LiquidityUSD: 100}
+	routed := &PricePath{Tokens: []string{"T", "USDT", "pTON"}, Pools: []string{"b", "c"}, LiquidityUSD: 50}
+	paths := []*PricePath{direct, direct, routed, nil, direct}
+
+	ph := NewPriceHistory()
+	start := time.Now().UTC().Truncate(24 * time.Hour).Add(-3 * priceHistoryInterval)
+	for i, path := range paths {
+		at := start.Add(time.Duration(i) * priceHistoryInterval)
+		ph.Record(testSnapshot(uint64(i+1), at, map[addrKey]Currency{token: {value: NewDecimal(int64(i + 1)), path: path}}), nil)
+	}
+
+	logged := 0
+	historyLog.Each(func(value json.RawMessage) {
+		r := new(PriceRecord)
+		if err := json.Unmarshal(value, r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Prices[token.String()].Path != nil {
+			logged++
+		}
+	})
+	// direct, routed, then lost route and direct again on the new day
+	if logged != 4 {
+		t.Errorf("logged %d paths, want 4", logged)
+	}
+
+	loaded := NewPriceHistory()
+	loaded.Load(historyLog)
+	if len(loaded.records) != len(paths) {
+		t.Fatalf("loaded %d records, want %d", len(loaded.records), len(paths))
+	}
+	for i, r := range loaded.records {
+		if got, want := pathRoute(r.Prices[token.String()].Path), pathRoute(paths[i]); got != want {
+			t.Errorf("record %d path %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestPriceHistoryAtBlockPastNewestRecord(t *testing.T) {
+	defer func(sl *SegmentLog) { historyLog = sl }(historyLog)
+	historyLog = nil
+
+	token := keyOf(testAddr(10))
+	ph := NewPriceHistory()
+	ph.Record(testSnapshot(100, time.Now(), map[addrKey]Currency{token: {value: NewDecimal(2)}}), nil)
+
+	span := uint32(priceHistoryInterval / masterchainBlockInterval)
+	if point, err := ph.AtBlock(testAddr(10), 100+span); err != nil || point.PriceUSD.Cmp(NewDecimal(2)) != 0 {
+		t.Errorf("price within a record interval of the newest record %v, err %v", point.PriceUSD, err)
+	}
+	if _, err := ph.AtBlock(testAddr(10), 100+span+1); err != errBlockNotRecorded {
+		t.Errorf("err %v past the newest record, want %v", err, errBlockNotRecorded)
+	}
+	if _, err := ph.AtBlock(testAddr(10), 99); err != errNoPriceHistory {
+		t.Errorf("err %v before the oldest record, want %v", err, errNoPriceHistory)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+// prices of every priced token at one point, never modified once published
+// so readers need no lock and always see prices computed together
+type PriceSnapshot struct {
+	version uint64
+	// highest masterchain seqno of the pool data priced from
+	block uint32
+	at    time.Time
+
+	prices  map[addrKey]Currency
+	anchors []AnchorStatus
+}
+
+var emptyPriceSnapshot = &PriceSnapshot{prices: make(map[addrKey]Currency)}
+
+func (ps *PriceSnapshot) Version() uint64 {
+	return ps.version
+}
+
+func (ps *PriceSnapshot) Block() uint32 {
+	return ps.block
+}
+
+func (ps *PriceSnapshot) At() time.Time {
+	return ps.at
+}
+
+func (ps *PriceSnapshot) price(master *address.Address) (Currency, bool) {
+	if master == nil {
+		return Currency{}, false
+	}
+
+	c, ok := ps.prices[keyOf(master)]
+	return c, ok
+}
+
+func (ps *PriceSnapshot) tonPrice() Decimal {
+	if c, ok := ps.price(tonMasterAddr); ok {
+		return c.value
+	}
+
+	return Decimal{}
+}
+
+// highest block any of pools was read at
+func maxPoolBlock(pools []*PoolInfo) uint32 {
+	block := uint32(0)
+	for _, pi := range pools {
+		if pi != nil && pi.block > block {
+			block = pi.block
+		}
+	}
+
+	return block
+}
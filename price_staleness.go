@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// prices older than this are stale: left out of outputs and pricing,
+// overridden by flag in main
+var priceMaxAge = 10 * time.Minute
+
+// stale prices are carried over until they are this many priceMaxAge old,
+// then dropped so dead tokens leave the price map
+var priceDropAfter = 6
+
+var errPriceStale = errors.New("price is stale")
+
+// pool data a price was derived from, for prices derived from several pools
+// the oldest of them since a price is only as fresh as its oldest input
+type priceSource struct {
+	block uint32
+	at    time.Time
+}
+
+func poolSource(pi *PoolInfo) priceSource {
+	return priceSource{block: pi.block, at: pi.updatedAt}
+}
+
+func (s priceSource) older(o priceSource) priceSource {
+	if o.at.Before(s.at) {
+		return o
+	}
+
+	return s
+}
+
+func (s priceSource) stale(now time.Time) bool {
+	return now.Sub(s.at) > priceMaxAge
+}
+
+// pools whose reserves are recent enough to price from, so a pool that
+// stopped refreshing gives way to other pools of the same token
+func freshPools(pools []*PoolInfo, now time.Time) []*PoolInfo {
+	fresh := make([]*PoolInfo, 0, len(pools))
+	for _, pi := range pools {
+		if !poolSource(pi).stale(now) {
+			fresh = append(fresh, pi)
+		}
+	}
+
+	return fresh
+}
+
+// keep the last price of tokens no fresh pool prices any more, with their
+// old source so readers see them as stale instead of losing them silently,
+// until priceDropAfter times priceMaxAge
+func carryOverPrices(prices, previous map[addrKey]Currency, now time.Time) {
+	for k, c := range previous {
+		if _, ok := prices[k]; ok {
+			continue
+		}
+
+		if now.Sub(c.source.at) > priceMaxAge*time.Duration(priceDropAfter) {
+			continue
+		}
+		prices[k] = c
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+var errUnknownPoolToken = errors.New("token is not in pool")
+
+type Quote struct {
+	Pool string `json:"pool"`
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	FromVerification string `json:"from_verification"`
+	ToVerification   string `json:"to_verification"`
+
+	AmountIn  string `json:"amount_in"`
+	AmountOut string `json:"amount_out"`
+
+	// lp fee is charged in the input token, protocol and ref fee in the output token
+	LPFee       string `json:"lp_fee"`
+	ProtocolFee string `json:"protocol_fee"`
+	RefFee      string `json:"ref_fee"`
+
+	SpotPrice      float64 `json:"spot_price"`
+	ExecutionPrice float64 `json:"execution_price"`
+	// output lost to curve movement, fees excluded, 0.01 is 1%
+	PriceImpact float64 `json:"price_impact"`
+}
+
+// get_expected_outputs of STON.fi v1 pool: lp fee is taken from the input,
+// protocol and ref fee are taken from the output and rounded up
+func expectedOutputs(amountIn, reserveIn, reserveOut *big.Int, lpFee, protocolFee, refFee int64, hasRef bool) (out, protocolFeeOut, refFeeOut *big.Int) {
+	divider := big.NewInt(feeDivider)
+
+	amountInWithFee := new(big.Int).Mul(amountIn, big.NewInt(feeDivider-lpFee))
+	baseOut := new(big.Int).Div(
+		new(big.Int).Mul(amountInWithFee, reserveOut),
+		new(big.Int).Add(new(big.Int).Mul(reserveIn, divider), amountInWithFee),
+	)
+
+	protocolFeeOut, refFeeOut = new(big.Int), new(big.Int)
+	if protocolFee > 0 {
+		protocolFeeOut = divCeil(new(big.Int).Mul(baseOut, big.NewInt(protocolFee)), divider)
+	}
+
+	if hasRef && refFee > 0 {
+		refFeeOut = divCeil(new(big.Int).Mul(baseOut, big.NewInt(refFee)), divider)
+	}
+
+	out = new(big.Int).Sub(baseOut, new(big.Int).Add(protocolFeeOut, refFeeOut))
+	return out, protocolFeeOut, refFeeOut
+}
+
+func divCeil(a, b *big.Int) *big.Int {
+	q, m := new(big.Int).QuoRem(a, b, new(big.Int))
+	if m.Sign() > 0 {
+		q.Add(q, big.NewInt(1))
+	}
+
+	return q
+}
+
+// quote swapping amountIn of token at index from (0 or 1) in pool
+func QuotePool(pool *PoolInfo, from int, amountIn *big.Int, hasRef bool) (*Quote, error) {
+	if pool.reserve0 == nil || pool.reserve1 == nil || pool.reserve0.Sign() == 0 || pool.reserve1.Sign() == 0 {
+		return nil, errors.New("pool has no liquidity")
+	}
+
+	if amountIn.Sign() <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+
+	reserveIn, reserveOut := pool.reserve0, pool.reserve1
+	if from == 1 {
+		reserveIn, reserveOut = pool.reserve1, pool.reserve0
+	}
+
+	out, protocolFeeOut, refFeeOut := expectedOutputs(amountIn, reserveIn, reserveOut, pool.lpFee, pool.protocolFee, pool.refFee, hasRef)
+	if out.Sign() < 0 {
+		out = new(big.Int)
+	}
+
+	// output of the same trade without any fee
+	noFeeOut := new(big.Int).Div(new(big.Int).Mul(amountIn, reserveOut), new(big.Int).Add(reserveIn, amountIn))
+
+	in := new(big.Float).SetInt(amountIn)
+	spot, _ := new(big.Float).Quo(new(big.Float).SetInt(reserveOut), new(big.Float).SetInt(reserveIn)).Float64()
+	execution, _ := new(big.Float).Quo(new(big.Float).SetInt(out), in).Float64()
+	noFee, _ := new(big.Float).Quo(new(big.Float).SetInt(noFeeOut), in).Float64()
+
+	return &Quote{
+		Pool: pool.addr.String(),
+		From: pool.tokenSymbol(from),
+		To:   pool.tokenSymbol(1 - from),
+
+		FromVerification: pool.tokenMaster(from).Verification(),
+		ToVerification:   pool.tokenMaster(1 - from).Verification(),
+
+		AmountIn:       amountIn.String(),
+		AmountOut:      out.String(),
+		LPFee:          new(big.Int).Div(new(big.Int).Mul(amountIn, big.NewInt(pool.lpFee)), big.NewInt(feeDivider)).String(),
+		ProtocolFee:    protocolFeeOut.String(),
+		RefFee:         refFeeOut.String(),
+		SpotPrice:      spot,
+		ExecutionPrice: execution,
+		PriceImpact:    1 - noFee/spot,
+	}, nil
+}
+
+func handleQuote(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	poolAddr, err := address.ParseAddr(query.Get("pool"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	pool := priceCollector.GetItem(poolAddr.String())
+	if pool == nil {
+		writeError(rw, http.StatusNotFound, errPoolNotFound)
+		return
+	}
+
+	from, err := pool.TokenIndex(query.Get("from"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	amountIn, ok := new(big.Int).SetString(query.Get("amount"), 10)
+	if !ok {
+		writeError(rw, http.StatusBadRequest, errors.New("invalid amount"))
+		return
+	}
+
+	hasRef, _ := strconv.ParseBool(query.Get("ref"))
+
+	quote, err := QuotePool(pool, from, amountIn, hasRef)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, quote)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	segmentDayLayout = "2006-01-02"
+	segmentExt       = ".jsonl"
+	// longest line a segment is read with
+	maxSegmentLine = 16 << 20
+)
+
+// append-only json lines, one file per utc day of the values' own time, so
+// growth costs one appended line and old data goes as whole files instead
+// of rewriting everything like Store.Flush does. a nil log keeps nothing
+type SegmentLog struct {
+	dir       string
+	retention time.Duration
+
+	mutex sync.Mutex
+	day   string
+	file  *os.File
+}
+
+func OpenSegmentLog(dir string, retention time.Duration) (*SegmentLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &SegmentLog{dir: dir, retention: retention, mutex: sync.Mutex{}}, nil
+}
+
+func segmentDay(at time.Time) string {
+	return at.UTC().Format(segmentDayLayout)
+}
+
+func (sl *SegmentLog) path(day string) string {
+	return filepath.Join(sl.dir, day+segmentExt)
+}
+
+// append v as one line to the file of at's day
+func (sl *SegmentLog) Append(at time.Time, v interface{}) {
+	if sl == nil {
+		return
+	}
+
+	line, err := json.Marshal(v)
+	if err != nil {
+		log.Debug().Err(err).Msgf("failed to encode value for %s", sl.dir)
+		return
+	}
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	day := segmentDay(at)
+	if sl.file == nil || sl.day != day {
+		if sl.file != nil {
+			sl.file.Close()
+		}
+
+		sl.file, err = os.OpenFile(sl.path(day), os.O_CREATE|os.O_WRONLY|os.O_APPEND, storeFilePermission)
+		if err != nil {
+			sl.file = nil
+			log.Error().Err(err).Msgf("failed to open segment %s of %s", day, sl.dir)
+			return
+		}
+		sl.day = day
+	}
+
+	if _, err := sl.file.Write(append(line, '\n')); err != nil {
+		log.Error().Err(err).Msgf("failed to append to segment %s of %s", day, sl.dir)
+	}
+}
+
+// segment days on disk, oldest first
+func (sl *SegmentLog) days() ([]string, error) {
+	entries, err := ioutil.ReadDir(sl.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	days := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		day := strings.TrimSuffix(name, segmentExt)
+		if _, err := time.Parse(segmentDayLayout, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+
+	return days, nil
+}
+
+// call fn for every line of days within retention, oldest day first and in
+// append order within a day
+func (sl *SegmentLog) Each(fn func(value json.RawMessage)) error {
+	if sl == nil {
+		return nil
+	}
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	days, err := sl.days()
+	if err != nil {
+		return err
+	}
+
+	cutoff := segmentDay(time.Now().Add(-sl.retention))
+	for _, day := range days {
+		if sl.retention > 0 && day < cutoff {
+			continue
+		}
+
+		if err := sl.read(day, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sl *SegmentLog) read(day string, fn func(value json.RawMessage)) error {
+	f, err := os.Open(sl.path(day))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), maxSegmentLine)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(line) > 0 {
+			fn(append(json.RawMessage(nil), line...))
+		}
+	}
+
+	// a crash mid append leaves a torn last line, readers skip it as
+	// invalid json
+	return scanner.Err()
+}
+
+// remove day files past retention, returns number of files removed
+func (sl *SegmentLog) Prune(now time.Time) int {
+	if sl == nil || sl.retention <= 0 {
+		return 0
+	}
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	days, err := sl.days()
+	if err != nil {
+		return 0
+	}
+
+	n, cutoff := 0, segmentDay(now.Add(-sl.retention))
+	for _, day := range days {
+		if day >= cutoff {
+			break
+		}
+
+		if day == sl.day && sl.file != nil {
+			sl.file.Close()
+			sl.file = nil
+		}
+		if err := os.Remove(sl.path(day)); err == nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// replace every day from the oldest one in values on with values, each
+// written through a temp file. days before it are left untouched
+func (sl *SegmentLog) Rewrite(values map[string][]interface{}) error {
+	if sl == nil {
+		return nil
+	}
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	if sl.file != nil {
+		sl.file.Close()
+		sl.file = nil
+	}
+
+	rewritten := make([]string, 0, len(values))
+	for day := range values {
+		rewritten = append(rewritten, day)
+	}
+	sort.Strings(rewritten)
+	if len(rewritten) == 0 {
+		return nil
+	}
+
+	days, err := sl.days()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if _, ok := values[day]; !ok && day >= rewritten[0] {
+			if err := os.Remove(sl.path(day)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, day := range rewritten {
+		if err := sl.writeDay(day, values[day]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sl *SegmentLog) writeDay(day string, values []interface{}) error {
+	tmp, err := ioutil.TempFile(sl.dir, day+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, v := range values {
+		line, err := json.Marshal(v)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), storeFilePermission); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), sl.path(day))
+}
+
+func (sl *SegmentLog) PeriodicallyPrune() {
+	ticker := time.NewTicker(time.Hour)
+	for range ticker.C {
+		if n := sl.Prune(time.Now()); n > 0 {
+			log.Info().Msgf("pruned %d old segments of %s", n, sl.dir)
+		}
+	}
+}
+
+// store buckets trades, candles and price history were kept in before they
+// moved to segment logs
+var legacySegmentBuckets = []string{"trades", "candles", "price_history"}
+
+// lock dir and open the trade, candle and price history logs in it,
+// errStoreLocked when a running dexstats holds it
+func openSegmentLogs(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	lock, err := lockFile(filepath.Join(dir, "LOCK"))
+	if err != nil {
+		return err
+	}
+	dataDirLock = lock
+
+	if tradeLog, err = OpenSegmentLog(filepath.Join(dir, "trades"), tradeRetention); err != nil {
+		return err
+	}
+	if candleLog, err = OpenSegmentLog(filepath.Join(dir, "candles"), candleRetention()); err != nil {
+		return err
+	}
+	historyLog, err = OpenSegmentLog(filepath.Join(dir, "price_history"), priceHistoryRetention)
+	return err
+}
+
+// move what stores written before segment logs hold in legacy buckets into
+// the logs and drop the buckets, kept as they are without a data dir
+func migrateLegacyBuckets(st *Store) {
+	if tradeLog == nil {
+		return
+	}
+
+	logs := map[string]*SegmentLog{"trades": tradeLog, "candles": candleLog, "price_history": historyLog}
+
+	for _, bucket := range legacySegmentBuckets {
+		n := 0
+		st.Each(bucket, func(_ string, value json.RawMessage, _ time.Time) {
+			// every legacy value carries its time as at or start
+			var stamp struct {
+				At    time.Time `json:"at"`
+				Start time.Time `json:"start"`
+			}
+			if err := json.Unmarshal(value, &stamp); err != nil {
+				return
+			}
+			if stamp.At.IsZero() {
+				stamp.At = stamp.Start
+			}
+
+			logs[bucket].Append(stamp.At, value)
+			n++
+		})
+
+		st.mutex.Lock()
+		if _, ok := st.buckets[bucket]; ok {
+			delete(st.buckets, bucket)
+			st.dirty = true
+		}
+		st.mutex.Unlock()
+
+		if n > 0 {
+			log.Info().Msgf("moved %d entries of store bucket %s to segments", n, bucket)
+		}
+	}
+}
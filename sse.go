@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -78,6 +79,18 @@ func (broker *SSEServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// send v as a named json event, for the events stream so consumers of the
+// csv swap lines on "/" never see json
+func (broker *SSEServer) Publish(event string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Debug().Err(err).Msgf("failed to encode %s event", event)
+		return
+	}
+
+	broker.Notifier <- []byte(fmt.Sprintf("event: %s\ndata: %s\n", event, payload))
+}
+
 func (broker *SSEServer) listen() {
 	for {
 		select {
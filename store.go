@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+// store buckets
+const (
+	bucketWalletMaster  = "wallet_master"
+	bucketJettonMaster  = "jetton_master"
+	bucketOffChainBody  = "offchain_body"
+	bucketLPBaseline    = "lp_baseline"
+	bucketSupplyHistory = "supply_history"
+	storeFlushInterval  = time.Second * 30
+	storeFilePermission = 0644
+)
+
+var storeBuckets = []string{bucketWalletMaster, bucketJettonMaster, bucketOffChainBody, bucketLPBaseline, bucketSupplyHistory}
+
+var (
+	walletMasterTTL = time.Hour * 24 * 30
+	offChainBodyTTL = time.Hour * 24
+)
+
+var errStoreLocked = errors.New("store is in use by a running dexstats")
+
+type storeEntry struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+func (e storeEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// local key value store persisted as a single json file, written back
+// periodically so metadata survives restarts without re-fetching
+type Store struct {
+	path string
+	lock *os.File
+
+	mutex   sync.Mutex
+	dirty   bool
+	buckets map[string]map[string]storeEntry
+}
+
+func OpenStore(path string) (*Store, error) {
+	st := &Store{
+		path:    path,
+		mutex:   sync.Mutex{},
+		buckets: make(map[string]map[string]storeEntry),
+	}
+
+	for _, bucket := range storeBuckets {
+		st.buckets[bucket] = make(map[string]storeEntry)
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make(map[string]map[string]storeEntry)
+	if err := json.Unmarshal(body, &loaded); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for bucket, entries := range loaded {
+		if st.buckets[bucket] == nil {
+			st.buckets[bucket] = make(map[string]storeEntry)
+		}
+
+		for k, e := range entries {
+			if !e.expired(now) {
+				st.buckets[bucket][k] = e
+			}
+		}
+	}
+
+	return st, nil
+}
+
+// decode live entry into v, false if missing or expired
+func (st *Store) Get(bucket, key string, v interface{}) bool {
+	if st == nil {
+		return false
+	}
+
+	st.mutex.Lock()
+	e, ok := st.buckets[bucket][key]
+	st.mutex.Unlock()
+
+	if !ok || e.expired(time.Now()) {
+		return false
+	}
+
+	if err := json.Unmarshal(e.Value, v); err != nil {
+		log.Debug().Err(err).Msgf("failed to decode %s/%s from store", bucket, key)
+		return false
+	}
+
+	return true
+}
+
+func (st *Store) Set(bucket, key string, v interface{}, ttl time.Duration) {
+	if st == nil {
+		return
+	}
+
+	value, err := json.Marshal(v)
+	if err != nil {
+		log.Debug().Err(err).Msgf("failed to encode %s/%s for store", bucket, key)
+		return
+	}
+
+	e := storeEntry{Value: value}
+	if ttl > 0 {
+		e.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.buckets[bucket] == nil {
+		st.buckets[bucket] = make(map[string]storeEntry)
+	}
+	st.buckets[bucket][key] = e
+	st.dirty = true
+}
+
+// call fn for every live entry of bucket in key order
+func (st *Store) Each(bucket string, fn func(key string, value json.RawMessage, expiresAt time.Time)) {
+	st.mutex.Lock()
+	entries := make(map[string]storeEntry, len(st.buckets[bucket]))
+	for k, e := range st.buckets[bucket] {
+		entries[k] = e
+	}
+	st.mutex.Unlock()
+
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	for _, k := range keys {
+		if e := entries[k]; !e.expired(now) {
+			fn(k, e.Value, e.ExpiresAt)
+		}
+	}
+}
+
+// drop all entries of bucket, or of every bucket if bucket is empty,
+// returns number of entries removed
+func (st *Store) Purge(bucket string) int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	n := 0
+	for b, entries := range st.buckets {
+		if bucket != "" && b != bucket {
+			continue
+		}
+
+		n += len(entries)
+		st.buckets[b] = make(map[string]storeEntry)
+	}
+
+	st.dirty = st.dirty || n > 0
+	return n
+}
+
+// drop expired entries, returns number of entries removed
+func (st *Store) PurgeExpired() int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	n, now := 0, time.Now()
+	for _, entries := range st.buckets {
+		for k, e := range entries {
+			if e.expired(now) {
+				delete(entries, k)
+				n++
+			}
+		}
+	}
+
+	st.dirty = st.dirty || n > 0
+	return n
+}
+
+// live entry count per bucket
+func (st *Store) Stats() map[string]int {
+	stats := make(map[string]int)
+	for _, bucket := range st.Buckets() {
+		n := 0
+		st.Each(bucket, func(string, json.RawMessage, time.Time) { n++ })
+		stats[bucket] = n
+	}
+
+	return stats
+}
+
+func (st *Store) Buckets() []string {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	buckets := make([]string, 0, len(st.buckets))
+	for b := range st.buckets {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+
+	return buckets
+}
+
+// take the exclusive lock on path.lock, held until exit by whoever writes
+// the store so cli purges and rebuilds never race a daemon's flushes
+func (st *Store) Lock() error {
+	f, err := lockFile(st.path + ".lock")
+	if err != nil {
+		return err
+	}
+
+	st.lock = f
+	return nil
+}
+
+// exclusive lock on path, errStoreLocked when another process holds it
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, storeFilePermission)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errStoreLocked
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// write store back to disk if anything changed, through a temp file so a
+// crash never leaves a truncated store behind. changes made while writing
+// keep the store dirty, a failed write keeps it dirty too
+func (st *Store) Flush() error {
+	st.mutex.Lock()
+	if !st.dirty {
+		st.mutex.Unlock()
+		return nil
+	}
+
+	body, err := json.Marshal(st.buckets)
+	st.dirty = false
+	st.mutex.Unlock()
+
+	if err == nil {
+		err = st.write(body)
+	}
+	if err != nil {
+		st.mutex.Lock()
+		st.dirty = true
+		st.mutex.Unlock()
+	}
+
+	return err
+}
+
+func (st *Store) write(body []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(st.path), filepath.Base(st.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), storeFilePermission); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), st.path)
+}
+
+// in-memory cache stats and live store entries per bucket, store is nil
+// when disabled
+type CacheReport struct {
+	WalletMaster CacheStats     `json:"wallet_master"`
+	Store        map[string]int `json:"store"`
+}
+
+func handleCache(rw http.ResponseWriter, req *http.Request) {
+	report := CacheReport{WalletMaster: jWalletMasterCache.Stats()}
+	if store != nil {
+		report.Store = store.Stats()
+	}
+
+	writeJSON(rw, http.StatusOK, report)
+}
+
+// warm in-memory caches from store at startup
+func loadStoreIntoCaches(st *Store) {
+	wallets, bodies := 0, 0
+
+	st.Each(bucketWalletMaster, func(key string, value json.RawMessage, _ time.Time) {
+		k, err := parseAddrKey(key)
+		if err != nil {
+			return
+		}
+
+		var master string
+		if err := json.Unmarshal(value, &master); err != nil {
+			return
+		}
+
+		masterAddr, err := address.ParseAddr(master)
+		if err != nil {
+			return
+		}
+
+		jWalletMasterCache.Set(address.NewAddress(0, byte(k.workchain), k.hash[:]), masterAddr)
+		wallets++
+	})
+
+	st.Each(bucketOffChainBody, func(uri string, value json.RawMessage, _ time.Time) {
+		var body string
+		if err := json.Unmarshal(value, &body); err != nil {
+			return
+		}
+
+		masterOffChainDataCache.Set(uri, []byte(body))
+		bodies++
+	})
+
+	log.Info().Msgf("loaded %d wallet master mappings and %d off-chain bodies from %s", wallets, bodies, st.path)
+}
+
+// persist pending candles and flush the store once more on SIGINT or
+// SIGTERM before exiting
+func flushOnShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Info().Msgf("received %s, flushing candles and store", sig)
+	candleAggregator.Persist()
+	if store == nil {
+		os.Exit(0)
+	}
+	if err := store.Flush(); err != nil {
+		log.Error().Err(err).Msgf("failed to flush store %s", store.path)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// POST /cache/purge?bucket=<bucket | expired | all>, purges go through the
+// daemon so its next flush doesn't write purged entries back
+func handleCachePurge(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+
+	if store == nil {
+		writeError(rw, http.StatusNotFound, errors.New("store is disabled"))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]int{"purged": store.PurgeBucket(req.URL.Query().Get("bucket"))})
+}
+
+// purge by cli argument: a bucket, expired or all
+func (st *Store) PurgeBucket(bucket string) int {
+	switch bucket {
+	case "expired":
+		return st.PurgeExpired()
+	case "all":
+		return st.Purge("")
+	default:
+		return st.Purge(bucket)
+	}
+}
+
+func (st *Store) PeriodicallyFlush() {
+	ticker := time.NewTicker(storeFlushInterval)
+	for range ticker.C {
+		if err := st.Flush(); err != nil {
+			log.Error().Err(err).Msgf("failed to flush store %s", st.path)
+		}
+	}
+}
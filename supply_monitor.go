@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/jetton"
+)
+
+const (
+	supplyEventType           = "supply_change"
+	supplyEventMint           = "mint"
+	supplyEventBurn           = "burn"
+	supplyEventAdminChange    = "admin_change"
+	supplyEventAdminRevoked   = "admin_revoked"
+	supplyEventMintableChange = "mintable_change"
+)
+
+var maxSupplyHistory = 1440
+
+var errNotWatched = errors.New("token is not in supply watchlist")
+
+type SupplyPoint struct {
+	At          time.Time `json:"at"`
+	TotalSupply string    `json:"total_supply"`
+	Mintable    bool      `json:"mintable"`
+	AdminAddr   string    `json:"admin_addr"`
+}
+
+type SupplyEvent struct {
+	Type   string    `json:"type"`
+	Event  string    `json:"event"`
+	Master string    `json:"master"`
+	Symbol string    `json:"symbol"`
+	Old    string    `json:"old"`
+	New    string    `json:"new"`
+	Delta  string    `json:"delta,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+type SupplyHistory struct {
+	Master string        `json:"master"`
+	Symbol string        `json:"symbol"`
+	Points []SupplyPoint `json:"points"`
+	Events []SupplyEvent `json:"events"`
+}
+
+// track total supply, mintable and admin of watchlist jettons, alert on
+// mint, burn and admin changes between refreshes
+type SupplyMonitor struct {
+	api      ton.APIClientWrapped
+	interval time.Duration
+
+	mutex     sync.Mutex
+	watchlist []*address.Address
+	histories map[addrKey]*SupplyHistory
+}
+
+func NewSupplyMonitor(api ton.APIClientWrapped, watchlist []*address.Address, interval time.Duration) *SupplyMonitor {
+	sm := &SupplyMonitor{
+		api:       api,
+		interval:  interval,
+		mutex:     sync.Mutex{},
+		watchlist: watchlist,
+		histories: make(map[addrKey]*SupplyHistory),
+	}
+
+	// pick up history recorded before a restart
+	for _, master := range watchlist {
+		history := &SupplyHistory{Master: master.String()}
+		store.Get(bucketSupplyHistory, keyOf(master).String(), history)
+		sm.histories[keyOf(master)] = history
+	}
+
+	return sm
+}
+
+// comma separated jetton master addresses
+func parseWatchlist(s string) ([]*address.Address, error) {
+	watchlist := make([]*address.Address, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		addr, err := address.ParseAddr(item)
+		if err != nil {
+			return nil, err
+		}
+		watchlist = append(watchlist, addr)
+	}
+
+	return watchlist, nil
+}
+
+func (sm *SupplyMonitor) PeriodicallyWatchSupply() {
+	if len(sm.watchlist) == 0 {
+		return
+	}
+
+	sm.refreshAll()
+
+	ticker := time.NewTicker(sm.interval)
+	for range ticker.C {
+		sm.refreshAll()
+	}
+}
+
+func (sm *SupplyMonitor) refreshAll() {
+	for _, master := range sm.watchlist {
+		data, err := jetton.NewJettonMasterClient(sm.api, master).GetJettonData(context.Background())
+		if err != nil {
+			log.Debug().Err(err).Msgf("failed to get supply of %s", master.String())
+			continue
+		}
+
+		point := SupplyPoint{
+			At:          time.Now(),
+			TotalSupply: data.TotalSupply.String(),
+			Mintable:    data.Mintable,
+		}
+		if data.AdminAddr != nil {
+			point.AdminAddr = data.AdminAddr.String()
+		}
+
+		symbol := ""
+		if info, err := jettonMasterCache.Get(sm.api, master); err == nil {
+			symbol = info.symbol
+		}
+
+		sm.observe(master, symbol, point)
+	}
+}
+
+func (sm *SupplyMonitor) observe(master *address.Address, symbol string, point SupplyPoint) {
+	sm.mutex.Lock()
+	history := sm.histories[keyOf(master)]
+	history.Symbol = symbol
+
+	var events []SupplyEvent
+	if n := len(history.Points); n > 0 {
+		events = supplyEvents(history.Points[n-1], point, master.String(), symbol)
+	}
+
+	history.Points = append(history.Points, point)
+	if len(history.Points) > maxSupplyHistory {
+		history.Points = history.Points[len(history.Points)-maxSupplyHistory:]
+	}
+	history.Events = append(history.Events, events...)
+	if len(history.Events) > maxSupplyHistory {
+		history.Events = history.Events[len(history.Events)-maxSupplyHistory:]
+	}
+	store.Set(bucketSupplyHistory, keyOf(master).String(), history, 0)
+	sm.mutex.Unlock()
+
+	for _, event := range events {
+		log.Warn().Msgf("jetton %s (%s) %s: %s -> %s", event.Symbol, event.Master, event.Event, event.Old, event.New)
+
+		sseEvents.Publish(supplyEventType, event)
+	}
+}
+
+func supplyEvents(prev, cur SupplyPoint, master, symbol string) []SupplyEvent {
+	events := make([]SupplyEvent, 0)
+	event := func(name, old, new string) SupplyEvent {
+		return SupplyEvent{Type: supplyEventType, Event: name, Master: master, Symbol: symbol, Old: old, New: new, At: cur.At}
+	}
+
+	prevSupply, _ := new(big.Int).SetString(prev.TotalSupply, 10)
+	curSupply, _ := new(big.Int).SetString(cur.TotalSupply, 10)
+	if prevSupply != nil && curSupply != nil {
+		delta := new(big.Int).Sub(curSupply, prevSupply)
+		if delta.Sign() != 0 {
+			name := supplyEventMint
+			if delta.Sign() < 0 {
+				name = supplyEventBurn
+			}
+
+			e := event(name, prev.TotalSupply, cur.TotalSupply)
+			e.Delta = delta.String()
+			events = append(events, e)
+		}
+	}
+
+	if prev.AdminAddr != cur.AdminAddr {
+		name := supplyEventAdminChange
+		if cur.AdminAddr == "" {
+			name = supplyEventAdminRevoked
+		}
+		events = append(events, event(name, prev.AdminAddr, cur.AdminAddr))
+	}
+
+	if prev.Mintable != cur.Mintable {
+		events = append(events, event(supplyEventMintableChange, strconv.FormatBool(prev.Mintable), strconv.FormatBool(cur.Mintable)))
+	}
+
+	return events
+}
+
+func (sm *SupplyMonitor) History(master *address.Address) *SupplyHistory {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	history, ok := sm.histories[keyOf(master)]
+	if !ok {
+		return nil
+	}
+
+	return &SupplyHistory{
+		Master: history.Master,
+		Symbol: history.Symbol,
+		Points: append([]SupplyPoint(nil), history.Points...),
+		Events: append([]SupplyEvent(nil), history.Events...),
+	}
+}
+
+func handleSupply(rw http.ResponseWriter, req *http.Request) {
+	master, err := address.ParseAddr(req.URL.Query().Get("token"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	history := supplyMonitor.History(master)
+	if history == nil {
+		writeError(rw, http.StatusNotFound, errNotWatched)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, history)
+}
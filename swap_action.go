@@ -8,7 +8,6 @@ import (
 	"strings"
 
 	"github.com/xssnick/tonutils-go/address"
-	"github.com/xssnick/tonutils-go/tlb"
 )
 
 type BuyOrSell string
@@ -29,6 +28,12 @@ type SwapAction struct {
 	token0Coins *big.Int
 	token1Coins *big.Int
 
+	// query id and receiver of the swap the router forwarded to the pool,
+	// and the amount the pool paid out for it once settled
+	queryID   uint64
+	receiver  *address.Address
+	amountOut *big.Int
+
 	pool *PoolInfo
 
 	now  uint32
@@ -46,6 +51,18 @@ func (sa *SwapAction) String() string {
 	sb.WriteString(fmt.Sprintf("OutCoins: %s\n", sa.token1Coins.String()))
 	sb.WriteString(fmt.Sprintf("Now: %d\n", sa.now))
 
+	if sa.pool != nil {
+		for _, master := range []*JettonMasterInfo{sa.pool.token0JettonMaster, sa.pool.token1JettonMaster} {
+			if master == nil {
+				continue
+			}
+
+			m := marketCapTracker.Market(master)
+			sb.WriteString(fmt.Sprintf("%s: circulating %s, marketcap $%s, fdv $%s\n",
+				m.Symbol, hUnits(m.CirculatingSupply, decimalsOf(master)), usdString(m.MarketCapUSD), usdString(m.FDVUSD)))
+		}
+	}
+
 	if sa.pool != nil {
 		sb.WriteString("=====  pool ==== \n")
 		sb.WriteString(sa.pool.String())
@@ -59,18 +76,18 @@ func (sa *SwapAction) Pretty() string {
 	sb.WriteString(fmt.Sprintf("%s %s %s %s for %s %s at TX %s",
 		s(sa.srcWallet),
 		sa.Action(),
-		h(sa.token0Coins),
-		sa.Token0Symbol(),
-		h(sa.token1Coins),
-		sa.Token1Symbol(),
+		h(sa.token0Coins, decimalsOf(sa.inMaster())),
+		symbolOf(sa.inMaster())+sa.inMaster().VerificationMark(),
+		h(sa.token1Coins, decimalsOf(sa.outMaster())),
+		symbolOf(sa.outMaster())+sa.outMaster().VerificationMark(),
 		base64.StdEncoding.EncodeToString(sa.hash)))
 
 	if sa.pool != nil {
 		sb.WriteString(fmt.Sprintf("POOL %s (reserve: %s[$ %s]/%s[$ %s]) ",
-			sa.pool.symbol, h(sa.pool.reserve0),
-			priceCollector.SymbolPriceFriendly(sa.pool.token0JettonMaster.symbol),
-			h(sa.pool.reserve1),
-			priceCollector.SymbolPriceFriendly(sa.pool.token1JettonMaster.symbol),
+			sa.pool.symbol, h(sa.pool.reserve0, decimalsOf(sa.pool.token0JettonMaster)),
+			priceCollector.TokenPriceFriendly(sa.pool.token0JettonMaster),
+			h(sa.pool.reserve1, decimalsOf(sa.pool.token1JettonMaster)),
+			priceCollector.TokenPriceFriendly(sa.pool.token1JettonMaster),
 		))
 	}
 
@@ -81,7 +98,7 @@ func (sa *SwapAction) Pretty() string {
 // b. Symbol: token symbol
 // c. Tx Hash
 // d. Trader wallet
-// e. Marketcap
+// e. Marketcap in usd over circulating supply
 // f. Token amt swapped
 // g. Amnt of Ton swapped
 // h. Type: buy or sell
@@ -90,39 +107,37 @@ func (sa *SwapAction) Pretty() string {
 // k. Liquidity reserves
 // l. Token balance held by the wallet (of the traded token)
 // m. Total supply
+// n. Token0 / token1 verification: verified, suspicious or unverified
+// o. Token0 / token1 fully diluted valuation in usd
+// p. Token0 / token1 circulating supply
 
 func (sa *SwapAction) LongPretty() string {
-	p0, err := priceCollector.SymbolPrice(sa.pool.token0JettonMaster.symbol)
-	if err != nil {
-		p0 = tlb.Coins{}
-	}
-
-	t0Market := new(big.Int).Mul(sa.pool.token0JettonMaster.totalSupply, p0.Nano())
-
-	p1, err := priceCollector.SymbolPrice(sa.pool.token1JettonMaster.symbol)
-	if err != nil {
-		p1 = tlb.Coins{}
-	}
-
-	t1Market := new(big.Int).Mul(sa.pool.token1JettonMaster.totalSupply, p1.Nano())
+	m0 := marketCapTracker.Market(sa.pool.token0JettonMaster)
+	m1 := marketCapTracker.Market(sa.pool.token1JettonMaster)
 
 	items := []string{
 		sa.pool.token0JettonMaster.name,
 		sa.pool.token0JettonMaster.symbol,
 		base64.StdEncoding.EncodeToString(sa.hash),
 		sa.srcWallet.String(),
-		t0Market.String(),
-		sa.token0Coins.String(),
-		sa.token1Coins.String(),
+		usdString(m0.MarketCapUSD),
+		h(sa.token0Coins, decimalsOf(sa.inMaster())),
+		h(sa.token1Coins, decimalsOf(sa.outMaster())),
 		string(sa.Action()),
-		p0.String(),
-		tonPrice.String(),
-		sa.pool.reserve0.String(),
-		sa.pool.reserve1.String(),
+		priceCollector.TokenPriceFriendly(sa.pool.token0JettonMaster),
+		priceCollector.TonPriceFriendly(),
+		h(sa.pool.reserve0, decimalsOf(sa.pool.token0JettonMaster)),
+		h(sa.pool.reserve1, decimalsOf(sa.pool.token1JettonMaster)),
 		"", // token balance held by the wallet
-		sa.pool.token0JettonMaster.totalSupply.String(),
-		sa.pool.token1JettonMaster.totalSupply.String(),
-		t1Market.String(),
+		h(sa.pool.token0JettonMaster.totalSupply, decimalsOf(sa.pool.token0JettonMaster)),
+		h(sa.pool.token1JettonMaster.totalSupply, decimalsOf(sa.pool.token1JettonMaster)),
+		usdString(m1.MarketCapUSD),
+		sa.pool.token0JettonMaster.Verification(),
+		sa.pool.token1JettonMaster.Verification(),
+		usdString(m0.FDVUSD),
+		usdString(m1.FDVUSD),
+		hUnits(m0.CirculatingSupply, decimalsOf(sa.pool.token0JettonMaster)),
+		hUnits(m1.CirculatingSupply, decimalsOf(sa.pool.token1JettonMaster)),
 	}
 
 	return strings.Join(items, ",")
@@ -145,13 +160,34 @@ func (sa *SwapAction) Action() BuyOrSell {
 		return Unknown
 	}
 
-	if sa.srcJettonMaster.symbol == sa.pool.GetToken0Symbol() {
+	if sa.pool.token0JettonMaster == nil {
+		return Unknown
+	}
+
+	if sameAddr(sa.srcJettonMaster.addr, sa.pool.token0JettonMaster.addr) {
 		return Buy
 	} else {
 		return Sell
 	}
 }
 
+// jetton sent to the pool, token0Coins are in it
+func (sa *SwapAction) inMaster() *JettonMasterInfo {
+	return sa.srcJettonMaster
+}
+
+// jetton received from the pool, token1Coins are in it
+func (sa *SwapAction) outMaster() *JettonMasterInfo {
+	switch sa.Action() {
+	case Buy:
+		return sa.pool.token1JettonMaster
+	case Sell:
+		return sa.pool.token0JettonMaster
+	default:
+		return nil
+	}
+}
+
 func (sa *SwapAction) Token0Symbol() string {
 	if sa.pool.token0JettonMaster != nil {
 		return sa.pool.token0JettonMaster.symbol
@@ -221,11 +257,38 @@ func ss(addr string) string {
 	return reg.ReplaceAllString(addr, "$1...$2")
 }
 
-func h(v *big.Int) string {
+// amount in units of a token with decimals, exact
+func h(v *big.Int, decimals int) string {
 	if v == nil {
 		return "nil"
 	}
 
-	coins := tlb.MustFromNano(v, 9)
-	return coins.String()
+	return DecimalFromUnits(v, decimals).String()
+}
+
+// h of base units held as a string, left as is when not an integer, e.g.
+// empty while unknown
+func hUnits(units string, decimals int) string {
+	v, ok := new(big.Int).SetString(units, 10)
+	if !ok {
+		return units
+	}
+
+	return h(v, decimals)
+}
+
+func decimalsOf(master *JettonMasterInfo) int {
+	if master == nil {
+		return defaultJettonDecimals
+	}
+
+	return master.decimals
+}
+
+func symbolOf(master *JettonMasterInfo) string {
+	if master == nil {
+		return "unknown"
+	}
+
+	return master.symbol
 }
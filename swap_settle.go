@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+)
+
+// pay_to exit codes of a STON.fi v1 pool, the owner's payout of a swap and
+// the referral's share of it
+const (
+	payToSwapOK    = uint64(0xc64370e5)
+	payToSwapOKRef = uint64(0x45078540)
+)
+
+// swaps and payouts not matched within this are dropped
+var swapSettleTimeout = 10 * time.Minute
+
+// pay_to a pool sends to the router once it executed a swap, the amount of
+// the side paid out is what the trader actually received
+type swapPayout struct {
+	pool     *address.Address
+	owner    *address.Address
+	queryID  uint64
+	exitCode uint64
+
+	amount0Out *big.Int
+	token0     *address.Address
+	amount1Out *big.Int
+	token1     *address.Address
+
+	at time.Time
+}
+
+// pay_to#f93bb43f query_id:uint64 to_address:MsgAddress exit_code:uint32
+// ref_coins_data:^[amount0_out:Coins token0_address:MsgAddress
+// amount1_out:Coins token1_address:MsgAddress], op already loaded
+func parseSwapPayout(in *cell.Slice, pool *address.Address) (*swapPayout, error) {
+	p := &swapPayout{pool: pool, at: time.Now()}
+
+	var err error
+	if p.queryID, err = in.LoadUInt(64); err != nil {
+		return nil, err
+	}
+	if p.owner, err = in.LoadAddr(); err != nil {
+		return nil, err
+	}
+	if p.exitCode, err = in.LoadUInt(32); err != nil {
+		return nil, err
+	}
+
+	ref, err := in.LoadRef()
+	if err != nil {
+		return nil, err
+	}
+	if p.amount0Out, err = ref.LoadBigCoins(); err != nil {
+		return nil, err
+	}
+	if p.token0, err = ref.LoadAddr(); err != nil {
+		return nil, err
+	}
+	if p.amount1Out, err = ref.LoadBigCoins(); err != nil {
+		return nil, err
+	}
+	if p.token1, err = ref.LoadAddr(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func settleKey(pool, owner *address.Address, queryID uint64) string {
+	return fmt.Sprintf("%s|%s|%d", keyOf(pool), keyOf(owner), queryID)
+}
+
+// match swaps the router forwarded to a pool with the pool's payout of
+// them, whichever arrives first waits for the other
+type SwapSettler struct {
+	mutex   sync.Mutex
+	swaps   map[string]*SwapAction
+	payouts map[string]*swapPayout
+	seen    map[string]time.Time
+}
+
+func NewSwapSettler() *SwapSettler {
+	return &SwapSettler{
+		mutex:   sync.Mutex{},
+		swaps:   make(map[string]*SwapAction),
+		payouts: make(map[string]*swapPayout),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+func (ss *SwapSettler) Swap(sa *SwapAction) {
+	if sa.pool == nil || sa.pool.addr == nil || sa.receiver == nil {
+		return
+	}
+	key := settleKey(sa.pool.addr, sa.receiver, sa.queryID)
+
+	ss.mutex.Lock()
+	ss.prune(time.Now())
+	p, ok := ss.payouts[key]
+	if ok {
+		delete(ss.payouts, key)
+		delete(ss.seen, key)
+	} else {
+		ss.swaps[key] = sa
+		ss.seen[key] = time.Now()
+	}
+	ss.mutex.Unlock()
+
+	if ok {
+		settleSwap(sa, p)
+	}
+}
+
+func (ss *SwapSettler) Payout(p *swapPayout) {
+	// the referral share is paid to the referral, not the trader
+	if p.exitCode == payToSwapOKRef {
+		return
+	}
+	key := settleKey(p.pool, p.owner, p.queryID)
+
+	ss.mutex.Lock()
+	ss.prune(time.Now())
+	sa, ok := ss.swaps[key]
+	if ok {
+		delete(ss.swaps, key)
+		delete(ss.seen, key)
+	} else {
+		ss.payouts[key] = p
+		ss.seen[key] = time.Now()
+	}
+	ss.mutex.Unlock()
+
+	if ok {
+		settleSwap(sa, p)
+	}
+}
+
+// drop what waited longer than swapSettleTimeout, called with mutex held
+func (ss *SwapSettler) prune(now time.Time) {
+	for key, at := range ss.seen {
+		if now.Sub(at) > swapSettleTimeout {
+			delete(ss.swaps, key)
+			delete(ss.payouts, key)
+			delete(ss.seen, key)
+		}
+	}
+}
+
+// refunds are not trades, executed swaps feed candles and price feeds with
+// the amount actually paid out
+func settleSwap(sa *SwapAction, p *swapPayout) {
+	if p.exitCode != payToSwapOK {
+		log.Debug().Msgf("swap %d of %s refunded with exit code %X", p.queryID, p.owner.String(), p.exitCode)
+		return
+	}
+
+	sa.amountOut = p.amount1Out
+	if sa.pool != nil && sameAddr(sa.srcJetton, sa.pool.token1Address) {
+		sa.amountOut = p.amount0Out
+	}
+
+	candleAggregator.Record(sa)
+	priceFeeds.Record(sa)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/ton/nft"
+)
+
+// TEP-64: decimals is 9 when the metadata does not say otherwise
+const defaultJettonDecimals = 9
+
+// token metadata fields defined by TEP-64, empty if absent
+type tep64Metadata struct {
+	URI         string
+	Name        string
+	Description string
+	Image       string
+	ImageData   []byte
+	Symbol      string
+	Decimals    string
+	AmountStyle string
+	RenderType  string
+}
+
+func onchainMetadata(c *nft.ContentOnchain) tep64Metadata {
+	return tep64Metadata{
+		URI:         c.GetAttribute("uri"),
+		Name:        c.Name,
+		Description: c.Description,
+		Image:       c.Image,
+		ImageData:   c.ImageData,
+		Symbol:      c.GetAttribute("symbol"),
+		Decimals:    c.GetAttribute("decimals"),
+		AmountStyle: c.GetAttribute("amount_style"),
+		RenderType:  c.GetAttribute("render_type"),
+	}
+}
+
+// off-chain json, decimals show up both as string and number,
+// image_data is base64 encoded
+func offchainMetadata(body []byte) (tep64Metadata, error) {
+	var content struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Image       string          `json:"image"`
+		ImageData   string          `json:"image_data"`
+		Symbol      string          `json:"symbol"`
+		Decimals    json.RawMessage `json:"decimals"`
+		AmountStyle string          `json:"amount_style"`
+		RenderType  string          `json:"render_type"`
+	}
+
+	if err := json.Unmarshal(body, &content); err != nil {
+		return tep64Metadata{}, err
+	}
+
+	m := tep64Metadata{
+		Name:        content.Name,
+		Description: content.Description,
+		Image:       content.Image,
+		Symbol:      content.Symbol,
+		Decimals:    strings.Trim(string(content.Decimals), `"`),
+		AmountStyle: content.AmountStyle,
+		RenderType:  content.RenderType,
+	}
+
+	if m.Decimals == "null" {
+		m.Decimals = ""
+	}
+
+	if content.ImageData != "" {
+		data, err := base64.StdEncoding.DecodeString(content.ImageData)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to decode off-chain image_data")
+		}
+		m.ImageData = data
+	}
+
+	return m, nil
+}
+
+// fill fields missing in m from fallback, m wins when both are set.
+// for semichain content on-chain values take precedence over off-chain ones
+func (m tep64Metadata) merge(fallback tep64Metadata) tep64Metadata {
+	pick := func(a, b string) string {
+		if a != "" {
+			return a
+		}
+		return b
+	}
+
+	merged := tep64Metadata{
+		URI:         pick(m.URI, fallback.URI),
+		Name:        pick(m.Name, fallback.Name),
+		Description: pick(m.Description, fallback.Description),
+		Image:       pick(m.Image, fallback.Image),
+		ImageData:   m.ImageData,
+		Symbol:      pick(m.Symbol, fallback.Symbol),
+		Decimals:    pick(m.Decimals, fallback.Decimals),
+		AmountStyle: pick(m.AmountStyle, fallback.AmountStyle),
+		RenderType:  pick(m.RenderType, fallback.RenderType),
+	}
+
+	if len(merged.ImageData) == 0 {
+		merged.ImageData = fallback.ImageData
+	}
+
+	return merged
+}
+
+func (m tep64Metadata) decimals() int {
+	if m.Decimals == "" {
+		return defaultJettonDecimals
+	}
+
+	d, err := strconv.Atoi(strings.TrimSpace(m.Decimals))
+	if err != nil || d < 0 || d > 255 {
+		log.Debug().Msgf("invalid decimals %q, using %d", m.Decimals, defaultJettonDecimals)
+		return defaultJettonDecimals
+	}
+
+	return d
+}
+
+func (info *JettonMasterInfo) applyMetadata(m tep64Metadata) {
+	info.name = m.Name
+	info.description = m.Description
+	info.image = m.Image
+	info.imageData = m.ImageData
+	info.symbol = m.Symbol
+	info.decimals = m.decimals()
+	info.amountStyle = m.AmountStyle
+	info.renderType = m.RenderType
+}
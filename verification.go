@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xssnick/tonutils-go/address"
+)
+
+// reasons a jetton is flagged
+const (
+	flagSymbolCollision   = "symbol_collision"
+	flagNameCollision     = "name_collision"
+	flagMintableWithAdmin = "mintable_with_admin"
+)
+
+const (
+	verificationVerified   = "verified"
+	verificationSuspicious = "suspicious"
+	verificationUnverified = "unverified"
+)
+
+// entry of the verified tokens file, a json array of these
+type verifiedToken struct {
+	Address string `json:"address"`
+	Symbol  string `json:"symbol"`
+	Name    string `json:"name"`
+}
+
+// curated allowlist of jetton masters, anything else sharing a symbol or
+// name with a verified token is a copycat
+type TokenVerifier struct {
+	mutex    sync.RWMutex
+	verified map[addrKey]verifiedToken
+	symbols  map[string]addrKey
+	names    map[string]addrKey
+}
+
+func NewTokenVerifier() *TokenVerifier {
+	return &TokenVerifier{
+		mutex:    sync.RWMutex{},
+		verified: make(map[addrKey]verifiedToken),
+		symbols:  make(map[string]addrKey),
+		names:    make(map[string]addrKey),
+	}
+}
+
+// copycats play with case, spacing and look-alike characters
+func normalizeTokenLabel(s string) string {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.NewReplacer("₮", "T", " ", "", ".", "", "-", "", "_", "").Replace(s)
+	return s
+}
+
+func (v *TokenVerifier) Add(token verifiedToken) error {
+	addr, err := address.ParseAddr(token.Address)
+	if err != nil {
+		return err
+	}
+
+	key := keyOf(addr)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.verified[key] = token
+	if sym := normalizeTokenLabel(token.Symbol); sym != "" {
+		v.symbols[sym] = key
+	}
+	if name := normalizeTokenLabel(token.Name); name != "" {
+		v.names[name] = key
+	}
+
+	return nil
+}
+
+// load allowlist from a json file
+func (v *TokenVerifier) LoadFile(path string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var tokens []verifiedToken
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		if err := v.Add(token); err != nil {
+			log.Error().Err(err).Msgf("invalid verified token %s", token.Address)
+		}
+	}
+
+	log.Info().Msgf("loaded %d verified tokens from %s", len(tokens), path)
+	return nil
+}
+
+// set verification attributes of info
+func (v *TokenVerifier) Verify(info *JettonMasterInfo) {
+	if info == nil || info.addr == nil {
+		return
+	}
+
+	key := keyOf(info.addr)
+	flags := make([]string, 0)
+
+	v.mutex.RLock()
+	_, verified := v.verified[key]
+	if !verified {
+		if other, ok := v.symbols[normalizeTokenLabel(info.symbol)]; ok && other != key {
+			flags = append(flags, flagSymbolCollision)
+		}
+
+		if other, ok := v.names[normalizeTokenLabel(info.name)]; ok && other != key {
+			flags = append(flags, flagNameCollision)
+		}
+	}
+	v.mutex.RUnlock()
+
+	// admin can mint any amount at any time
+	if info.mintable && info.adminAddr != nil {
+		flags = append(flags, flagMintableWithAdmin)
+	}
+
+	info.verified = verified
+	info.flags = flags
+	info.suspicious = !verified && len(flags) > 0
+}
+
+func (info *JettonMasterInfo) Verification() string {
+	switch {
+	case info == nil:
+		return verificationUnverified
+	case info.verified:
+		return verificationVerified
+	case info.suspicious:
+		return verificationSuspicious
+	default:
+		return verificationUnverified
+	}
+}
+
+// short marker for one line outputs, empty for verified and plain unverified tokens
+func (info *JettonMasterInfo) VerificationMark() string {
+	if info != nil && info.suspicious {
+		return "[suspicious:" + strings.Join(info.flags, "|") + "]"
+	}
+
+	return ""
+}